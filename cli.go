@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const usage = `usage:
+  nudgeme [flags]                 serve, see -h for the flags
+  nudgeme config check            validate and print the configuration
+  nudgeme migrate up              apply pending migrations
+  nudgeme migrate down [steps]    revert the latest migrations of the main
+                                  database, 1 by default
+  nudgeme migrate status          list migrations and when they were applied
+  nudgeme lockouts list           list failed password checks and lockouts
+  nudgeme lockouts clear <key>    forget the failures recorded under key, e.g.
+                                  id:abc1337 or ip:203.0.113.7
+  nudgeme reports list            list reported messages not yet resolved
+  nudgeme reports resolve <id>    mark a report as dealt with`
+
+// runs a subcommand, args excludes the program name
+func runCommand(cfg *Config, args []string) error {
+	switch args[0] {
+	case "config":
+		return runConfig(cfg, args[1:])
+	case "migrate":
+		return runMigrate(cfg, args[1:])
+	case "lockouts":
+		return runLockouts(cfg, args[1:])
+	case "reports":
+		return runReports(cfg, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func runConfig(cfg *Config, args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New(usage)
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(cfg.redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	fmt.Println("configuration is valid")
+	return nil
+}
+
+func runMigrate(cfg *Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	dbs := openDatabases(cfg.Database, false)
+	defer dbs.Close()
+	targets := dbs.migrationTargets()
+
+	switch args[0] {
+	case "up":
+		for _, target := range targets {
+			applied, err := migrateUp(target.db, target.set)
+			fmt.Printf("%s: applied %d migration(s)\n", target.set, applied)
+			if err != nil {
+				return err
+			}
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		// the mock database is left alone, reverting it only loses the demo data
+		target := targets[0]
+		reverted, err := migrateDown(target.db, target.set, steps)
+		fmt.Printf("%s: reverted %d migration(s)\n", target.set, reverted)
+		return err
+	case "status":
+		for _, target := range targets {
+			states, err := migrationStatus(target.db, target.set)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s:\n", target.set)
+			for _, state := range states {
+				applied := "pending"
+				if state.appliedAt != nil {
+					applied = "applied " + state.appliedAt.Format("2006-01-02 15:04:05")
+				}
+				fmt.Printf("  %-40s %s\n", state.name, applied)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q\n%s", args[0], usage)
+	}
+	return nil
+}
+
+func runLockouts(cfg *Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	dbs := openDatabases(cfg.Database, false)
+	defer dbs.Close()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "list":
+		lockouts, err := dbs.mydb.ListLockouts(ctx)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, lockout := range lockouts {
+			state := ""
+			if lockout.isLocked(now) {
+				state = "locked until " + lockout.LockedUntil.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%-40s %3d failure(s), last %s  %s\n", lockout.Key, lockout.Failures,
+				lockout.LastFailure.Local().Format("2006-01-02 15:04:05"), state)
+		}
+	case "clear":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+		cleared, err := dbs.mydb.ClearLockout(ctx, args[1])
+		if err != nil {
+			return err
+		} else if !cleared {
+			return fmt.Errorf("nothing recorded under %q", args[1])
+		}
+		fmt.Printf("cleared %s\n", args[1])
+	default:
+		return fmt.Errorf("unknown lockouts command %q\n%s", args[0], usage)
+	}
+	return nil
+}
+
+func runReports(cfg *Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	dbs := openDatabases(cfg.Database, false)
+	defer dbs.Close()
+	ctx := context.Background()
+
+	switch args[0] {
+	case "list":
+		reports, err := dbs.mydb.ListOpenReports(ctx)
+		if err != nil {
+			return err
+		}
+		for _, report := range reports {
+			fmt.Printf("%6d  %s  %s reported %s %d from %s: %q\n", report.ID,
+				report.CreatedAt.Local().Format("2006-01-02 15:04:05"), report.Reporter,
+				report.Channel, report.MessageID, report.Reported, report.Reason)
+			fmt.Printf("        %s\n", report.Data)
+		}
+	case "resolve":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid report ID %q", args[1])
+		}
+		resolved, err := dbs.mydb.ResolveReport(ctx, id)
+		if err != nil {
+			return err
+		} else if !resolved {
+			return fmt.Errorf("no open report %d", id)
+		}
+		fmt.Printf("resolved report %d\n", id)
+	default:
+		return fmt.Errorf("unknown reports command %q\n%s", args[0], usage)
+	}
+	return nil
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// server configuration. Loaded from the defaults, then the JSON config file,
+// then environment variables, then flags, each overriding the last.
+type Config struct {
+	Listen string `json:"listen"` // address to serve on, e.g. ":443"
+	Domain string `json:"domain"` // domain name the server is reached through
+
+	TLS      TLSConfig      `json:"tls"`
+	Database DatabaseConfig `json:"database"`
+	Cache    CacheConfig    `json:"cache"`
+
+	// how often the /map data is recomputed
+	TemplateRefresh Duration `json:"template_refresh"`
+
+	// how long to wait for in-flight requests when shutting down
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	// key used to sign session tokens and invites
+	SessionSecret string `json:"session_secret"`
+
+	// only say whether a user exists to logged in users, or those with the
+	// user's password or invite, see handleCheckUser
+	RequireLookupProof bool `json:"require_lookup_proof"`
+
+	// refuse new messages and nudges that aren't signed with the sender's
+	// registered key. Signed ones are checked either way.
+	RequireSignedMessages bool `json:"require_signed_messages"`
+
+	// only deliver messages and nudges between users who have accepted each
+	// other as contacts
+	RequireContacts bool `json:"require_contacts"`
+
+	Passwords  PasswordConfig   `json:"passwords"`
+	Lockout    LockoutConfig    `json:"lockout"`
+	RateLimits RateLimitConfig  `json:"rate_limits"`
+	MessageTTL MessageTTLConfig `json:"message_ttl"`
+}
+
+type TLSConfig struct {
+	// "autocert" to get certificates from Let's Encrypt, "static" to use
+	// CertFile and KeyFile, "selfsigned" to generate one on start up for
+	// development, or "http" to serve plain HTTP behind a TLS terminating proxy
+	Mode     string `json:"mode"`
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// addresses or CIDR ranges of the proxies whose X-Forwarded-For headers
+	// are trusted, in http mode
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+type DatabaseConfig struct {
+	Driver string `json:"driver"` // "mysql" or "sqlite"
+
+	// MySQL connection
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Address  string `json:"address"`   // host:port
+	Name     string `json:"name"`      // main database
+	MockName string `json:"mock_name"` // database holding MOCK_DATA
+
+	// SQLite file, holding everything
+	SQLitePath string `json:"sqlite_path"`
+
+	// longest a single query may take
+	QueryTimeout Duration `json:"query_timeout"`
+}
+
+// how password digests are made, see passwords.go. Changing any of it
+// upgrades digests as users log in.
+type PasswordConfig struct {
+	Algorithm string `json:"algorithm"` // "argon2id" or "bcrypt"
+
+	// bcrypt work factor
+	BcryptCost int `json:"bcrypt_cost"`
+
+	// Argon2id costs
+	Argon2MemoryKiB   int `json:"argon2_memory_kib"`
+	Argon2Iterations  int `json:"argon2_iterations"`
+	Argon2Parallelism int `json:"argon2_parallelism"`
+}
+
+// how password guessing is slowed down, see lockout.go
+type LockoutConfig struct {
+	// failed password checks allowed for an identifier, and from an IP
+	// address, before it is locked out. 0 disables either.
+	IdentifierThreshold int `json:"identifier_threshold"`
+	IPThreshold         int `json:"ip_threshold"`
+
+	// the first lockout lasts BaseDelay, each further failure doubles it up
+	// to MaxDelay. Failures are forgotten after MaxDelay without any.
+	BaseDelay Duration `json:"base_delay"`
+	MaxDelay  Duration `json:"max_delay"`
+}
+
+// requests allowed per client to each group of write endpoints, see
+// ratelimit.go
+type RateLimitConfig struct {
+	Signup    RateLimit `json:"signup"`    // /user/new
+	Message   RateLimit `json:"message"`   // /user/message/new and /user/nudge/new
+	Wellbeing RateLimit `json:"wellbeing"` // /add-wellbeing-record
+}
+
+// how long messages and nudges wait to be acked before they are deleted,
+// see sweeper.go. 0 keeps them until acked.
+type MessageTTLConfig struct {
+	Message Duration `json:"message"`
+	Nudge   Duration `json:"nudge"`
+
+	// how often expired ones are deleted
+	SweepInterval Duration `json:"sweep_interval"`
+}
+
+type CacheConfig struct {
+	AutocertDir string `json:"autocert_dir"` // where TLS certificates are kept
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen: ":443",
+		TLS:    TLSConfig{Mode: listenAutocert},
+		Database: DatabaseConfig{
+			Driver:       "mysql",
+			User:         "root",
+			Address:      "178.79.172.202:3306",
+			Name:         "team26",
+			MockName:     "newdatabase",
+			SQLitePath:   "nudgeme.db",
+			QueryTimeout: Duration{5 * time.Second},
+		},
+		Cache:           CacheConfig{AutocertDir: "/var/www/.cache"},
+		TemplateRefresh: Duration{2 * time.Minute},
+		ShutdownTimeout: Duration{15 * time.Second},
+		Passwords: PasswordConfig{
+			Algorithm:  algorithmArgon2id,
+			BcryptCost: bcrypt.DefaultCost,
+			// the OWASP recommendation, cheap enough for our small server
+			Argon2MemoryKiB:   19 * 1024,
+			Argon2Iterations:  2,
+			Argon2Parallelism: 1,
+		},
+		Lockout: LockoutConfig{
+			IdentifierThreshold: 5,
+			// higher, since many people can share an address
+			IPThreshold: 20,
+			BaseDelay:   Duration{30 * time.Second},
+			MaxDelay:    Duration{time.Hour},
+		},
+		RateLimits: RateLimitConfig{
+			Signup:    RateLimit{Requests: 5, Per: time.Hour},
+			Message:   RateLimit{Requests: 60, Per: time.Minute},
+			Wellbeing: RateLimit{Requests: 10, Per: time.Hour},
+		},
+		MessageTTL: MessageTTLConfig{
+			Message:       Duration{30 * 24 * time.Hour},
+			Nudge:         Duration{7 * 24 * time.Hour},
+			SweepInterval: Duration{10 * time.Minute},
+		},
+	}
+}
+
+// a setting that can be given as an environment variable or a flag
+type configSetting struct {
+	env   string
+	flag  string
+	usage string
+	value flag.Value
+}
+
+func (cfg *Config) settings() []configSetting {
+	return []configSetting{
+		{"LISTEN_ADDRESS", "listen", "address to serve on", (*stringValue)(&cfg.Listen)},
+		{"DOMAIN_NAME", "domain", "domain name of the server", (*stringValue)(&cfg.Domain)},
+		{"TLS_MODE", "tls-mode", `"autocert", "static", "selfsigned" or "http"`,
+			(*stringValue)(&cfg.TLS.Mode)},
+		{"TLS_CERT_FILE", "tls-cert", "certificate file, in static mode", (*stringValue)(&cfg.TLS.CertFile)},
+		{"TLS_KEY_FILE", "tls-key", "key file, in static mode", (*stringValue)(&cfg.TLS.KeyFile)},
+		{"TRUSTED_PROXIES", "trusted-proxies", "comma separated proxy addresses, in http mode",
+			(*stringListValue)(&cfg.TLS.TrustedProxies)},
+		{"DB_DRIVER", "db-driver", `"mysql" or "sqlite"`, (*stringValue)(&cfg.Database.Driver)},
+		{"DB_USER", "db-user", "MySQL user", (*stringValue)(&cfg.Database.User)},
+		{"SQL_PASSWORD", "db-password", "MySQL password", (*stringValue)(&cfg.Database.Password)},
+		{"DB_ADDRESS", "db-address", "MySQL host:port", (*stringValue)(&cfg.Database.Address)},
+		{"DB_NAME", "db-name", "main MySQL database", (*stringValue)(&cfg.Database.Name)},
+		{"DB_MOCK_NAME", "db-mock-name", "MySQL database holding MOCK_DATA",
+			(*stringValue)(&cfg.Database.MockName)},
+		{"SQLITE_PATH", "sqlite-path", "SQLite database file", (*stringValue)(&cfg.Database.SQLitePath)},
+		{"DB_QUERY_TIMEOUT", "db-query-timeout", "longest a query may take, e.g. 5s",
+			&cfg.Database.QueryTimeout},
+		{"AUTOCERT_CACHE_DIR", "autocert-dir", "directory to cache TLS certificates in",
+			(*stringValue)(&cfg.Cache.AutocertDir)},
+		{"TEMPLATE_REFRESH", "template-refresh", "how often to recompute the map data, e.g. 2m",
+			&cfg.TemplateRefresh},
+		{"SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long to wait for requests on shutdown, e.g. 15s",
+			&cfg.ShutdownTimeout},
+		{"SESSION_SECRET", "session-secret", "key used to sign session tokens",
+			(*stringValue)(&cfg.SessionSecret)},
+		{"REQUIRE_LOOKUP_PROOF", "require-lookup-proof",
+			"only tell logged in users, or those with an invite, whether a user exists",
+			(*boolValue)(&cfg.RequireLookupProof)},
+		{"REQUIRE_SIGNED_MESSAGES", "require-signed-messages",
+			"refuse messages and nudges that aren't signed with the sender's key",
+			(*boolValue)(&cfg.RequireSignedMessages)},
+		{"REQUIRE_CONTACTS", "require-contacts",
+			"only deliver messages and nudges between accepted contacts",
+			(*boolValue)(&cfg.RequireContacts)},
+		{"PASSWORD_ALGORITHM", "password-algorithm", `"argon2id" or "bcrypt", for new password digests`,
+			(*stringValue)(&cfg.Passwords.Algorithm)},
+		{"BCRYPT_COST", "bcrypt-cost", "bcrypt work factor for password digests",
+			(*intValue)(&cfg.Passwords.BcryptCost)},
+		{"ARGON2_MEMORY_KIB", "argon2-memory", "Argon2id memory cost, in KiB",
+			(*intValue)(&cfg.Passwords.Argon2MemoryKiB)},
+		{"ARGON2_ITERATIONS", "argon2-iterations", "Argon2id time cost",
+			(*intValue)(&cfg.Passwords.Argon2Iterations)},
+		{"ARGON2_PARALLELISM", "argon2-parallelism", "Argon2id threads",
+			(*intValue)(&cfg.Passwords.Argon2Parallelism)},
+		{"LOCKOUT_IDENTIFIER_THRESHOLD", "lockout-identifier-threshold",
+			"failed password checks before an identifier is locked out, 0 to disable",
+			(*intValue)(&cfg.Lockout.IdentifierThreshold)},
+		{"LOCKOUT_IP_THRESHOLD", "lockout-ip-threshold",
+			"failed password checks before an IP address is locked out, 0 to disable",
+			(*intValue)(&cfg.Lockout.IPThreshold)},
+		{"LOCKOUT_BASE_DELAY", "lockout-base-delay", "length of the first lockout, e.g. 30s",
+			&cfg.Lockout.BaseDelay},
+		{"LOCKOUT_MAX_DELAY", "lockout-max-delay", "longest lockout, e.g. 1h",
+			&cfg.Lockout.MaxDelay},
+		{"RATE_LIMIT_SIGNUP", "rate-limit-signup", "sign ups allowed per client, e.g. 5/1h, 0 to disable",
+			&cfg.RateLimits.Signup},
+		{"RATE_LIMIT_MESSAGE", "rate-limit-message",
+			"messages and nudges allowed per client, e.g. 60/1m, 0 to disable",
+			&cfg.RateLimits.Message},
+		{"RATE_LIMIT_WELLBEING", "rate-limit-wellbeing",
+			"wellbeing records allowed per client, e.g. 10/1h, 0 to disable",
+			&cfg.RateLimits.Wellbeing},
+		{"MESSAGE_TTL", "message-ttl", "how long messages are kept unacked, e.g. 720h, 0 for ever",
+			&cfg.MessageTTL.Message},
+		{"NUDGE_TTL", "nudge-ttl", "how long nudges are kept unacked, e.g. 168h, 0 for ever",
+			&cfg.MessageTTL.Nudge},
+		{"MESSAGE_SWEEP_INTERVAL", "message-sweep-interval",
+			"how often expired messages and nudges are deleted, e.g. 10m",
+			&cfg.MessageTTL.SweepInterval},
+	}
+}
+
+// loads the configuration. args are the command line arguments excluding the
+// program name; the ones left after the flags are returned.
+func loadConfig(args []string) (*Config, []string, error) {
+	// the flags are parsed twice: once to find the config file, then again
+	// on top of the file and environment variables so they take precedence
+	var configPath string
+	scratch := defaultConfig()
+	if err := configFlags(&scratch, &configPath).Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if configPath == "" {
+		configPath = os.Getenv("NUDGEME_CONFIG")
+	}
+
+	cfg := defaultConfig()
+	if configPath != "" {
+		contents, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal(contents, &cfg); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", configPath, err)
+		}
+	}
+
+	for _, setting := range cfg.settings() {
+		if value, ok := os.LookupEnv(setting.env); ok && value != "" {
+			if err := setting.value.Set(value); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", setting.env, err)
+			}
+		}
+	}
+
+	flags := configFlags(&cfg, &configPath)
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	return &cfg, flags.Args(), nil
+}
+
+func configFlags(cfg *Config, configPath *string) *flag.FlagSet {
+	flags := flag.NewFlagSet("nudgeme", flag.ContinueOnError)
+	flags.StringVar(configPath, "config", "", "JSON config file, also NUDGEME_CONFIG")
+	for _, setting := range cfg.settings() {
+		flags.Var(setting.value, setting.flag, setting.usage+", also "+setting.env)
+	}
+	return flags
+}
+
+// returns an error describing everything wrong with the configuration
+func (cfg *Config) Validate() error {
+	problems := make([]string, 0)
+	if cfg.Listen == "" {
+		problems = append(problems, "listen address is required")
+	}
+	switch cfg.TLS.Mode {
+	case listenAutocert:
+		if cfg.Domain == "" {
+			problems = append(problems, "domain is required for Auto TLS")
+		}
+		if cfg.Cache.AutocertDir == "" {
+			problems = append(problems, "autocert cache directory is required")
+		}
+	case listenStatic:
+		if cfg.TLS.CertFile == "" || cfg.TLS.KeyFile == "" {
+			problems = append(problems, "static TLS needs a certificate and key file")
+		}
+	case listenSelfSigned, listenHTTP:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown listen mode %q", cfg.TLS.Mode))
+	}
+	for _, proxy := range cfg.TLS.TrustedProxies {
+		if _, err := parseIPRange(proxy); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if cfg.TemplateRefresh.Duration <= 0 {
+		problems = append(problems, "template refresh interval must be positive")
+	}
+	if cfg.ShutdownTimeout.Duration <= 0 {
+		problems = append(problems, "shutdown timeout must be positive")
+	}
+
+	passwords := cfg.Passwords
+	switch passwords.Algorithm {
+	case algorithmBcrypt:
+		if passwords.BcryptCost < bcrypt.MinCost || passwords.BcryptCost > bcrypt.MaxCost {
+			problems = append(problems, fmt.Sprintf("bcrypt cost must be between %d and %d",
+				bcrypt.MinCost, bcrypt.MaxCost))
+		}
+	case algorithmArgon2id:
+		if passwords.Argon2Iterations < 1 || passwords.Argon2Parallelism < 1 ||
+			passwords.Argon2Parallelism > 255 {
+			problems = append(problems,
+				"Argon2id needs at least 1 iteration and between 1 and 255 threads")
+		}
+		// Argon2 needs 8 KiB per thread
+		if passwords.Argon2MemoryKiB < 8*passwords.Argon2Parallelism {
+			problems = append(problems, "Argon2id memory must be at least 8 KiB per thread")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown password algorithm %q", passwords.Algorithm))
+	}
+
+	lockout := cfg.Lockout
+	if lockout.IdentifierThreshold < 0 || lockout.IPThreshold < 0 {
+		problems = append(problems, "lockout thresholds can't be negative")
+	}
+	if lockout.BaseDelay.Duration <= 0 || lockout.MaxDelay.Duration < lockout.BaseDelay.Duration {
+		problems = append(problems,
+			"lockout base delay must be positive and no longer than the max delay")
+	}
+
+	ttl := cfg.MessageTTL
+	if ttl.Message.Duration < 0 || ttl.Nudge.Duration < 0 {
+		problems = append(problems, "message TTLs can't be negative")
+	}
+	if ttl.SweepInterval.Duration <= 0 {
+		problems = append(problems, "message sweep interval must be positive")
+	}
+
+	db := cfg.Database
+	if db.QueryTimeout.Duration <= 0 {
+		problems = append(problems, "query timeout must be positive")
+	}
+	switch db.Driver {
+	case "mysql":
+		if db.User == "" || db.Address == "" || db.Name == "" || db.MockName == "" {
+			problems = append(problems,
+				"MySQL needs a user, address, database name and mock database name")
+		}
+	case "sqlite":
+		if db.SQLitePath == "" {
+			problems = append(problems, "SQLite needs a database path")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown database driver %q", db.Driver))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// returns a copy of the configuration that is safe to print
+func (cfg Config) redacted() Config {
+	if cfg.Database.Password != "" {
+		cfg.Database.Password = "REDACTED"
+	}
+	if cfg.SessionSecret != "" {
+		cfg.SessionSecret = "REDACTED"
+	}
+	return cfg
+}
+
+// a time.Duration written like "2m" in the config file and flags
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) Set(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return d.Set(value)
+}
+
+// a string that implements flag.Value
+type stringValue string
+
+func (s *stringValue) Set(value string) error {
+	*s = stringValue(value)
+	return nil
+}
+
+func (s *stringValue) String() string {
+	if s == nil {
+		return ""
+	}
+	return string(*s)
+}
+
+// an int that implements flag.Value
+type intValue int
+
+func (i *intValue) Set(value string) error {
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*i = intValue(parsed)
+	return nil
+}
+
+func (i *intValue) String() string {
+	if i == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*i))
+}
+
+// a bool that implements flag.Value, and can be given as just `-flag`
+type boolValue bool
+
+func (b *boolValue) Set(value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*b = boolValue(parsed)
+	return nil
+}
+
+func (b *boolValue) String() string {
+	if b == nil {
+		return "false"
+	}
+	return strconv.FormatBool(bool(*b))
+}
+
+func (b *boolValue) IsBoolFlag() bool {
+	return true
+}
+
+// a comma separated list that implements flag.Value
+type stringListValue []string
+
+func (l *stringListValue) Set(value string) error {
+	*l = make(stringListValue, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func (l *stringListValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sets an environment variable for the rest of the test
+func setEnv(t *testing.T, key string, value string) {
+	old, had := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nudgeme.json")
+	contents := `{"listen": ":8443", "domain": "file.example",
+		"database": {"name": "from_file", "user": "file_user"},
+		"template_refresh": "5m"}`
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setEnv(t, "DOMAIN_NAME", "env.example")
+	setEnv(t, "DB_NAME", "from_env")
+
+	cfg, args, err := loadConfig([]string{"-config", path, "-db-name", "from_flag",
+		"migrate", "up"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"migrate", "up"}, args)
+		assert.Equal(t, ":8443", cfg.Listen)                  // file
+		assert.Equal(t, "file_user", cfg.Database.User)       // file
+		assert.Equal(t, "env.example", cfg.Domain)            // env over file
+		assert.Equal(t, "from_flag", cfg.Database.Name)       // flag over env
+		assert.Equal(t, "newdatabase", cfg.Database.MockName) // default
+		assert.Equal(t, 5*time.Minute, cfg.TemplateRefresh.Duration)
+	}
+}
+
+func TestConfigBadDuration(t *testing.T) {
+	_, _, err := loadConfig([]string{"-template-refresh", "soon"})
+	assert.Error(t, err)
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Domain = "example.com"
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Database.Driver = "postgres"
+	cfg.TemplateRefresh.Duration = 0
+	err := cfg.Validate()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown database driver")
+		assert.Contains(t, err.Error(), "template refresh")
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Database.Password = "hunter2"
+	cfg.SessionSecret = "secret"
+
+	redacted := cfg.redacted()
+	assert.Equal(t, "REDACTED", redacted.Database.Password)
+	assert.Equal(t, "REDACTED", redacted.SessionSecret)
+	assert.Equal(t, "hunter2", cfg.Database.Password)
+}
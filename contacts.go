@@ -0,0 +1,67 @@
+package main
+
+import "time"
+
+// contact statuses
+const (
+	contactPending  = "pending"
+	contactAccepted = "accepted"
+)
+
+// a contact between two users, who are stored in sorted order so each pair
+// has one row, see newContact
+type Contact struct {
+	IdentifierA string
+	IdentifierB string
+	RequestedBy string
+	Status      string
+	UpdatedAt   time.Time
+}
+
+// a contact request from requester to addressee
+func newContact(requester string, addressee string) Contact {
+	a, b := contactPair(requester, addressee)
+	return Contact{IdentifierA: a, IdentifierB: b, RequestedBy: requester,
+		Status: contactPending, UpdatedAt: time.Now().UTC().Truncate(time.Second)}
+}
+
+// returns the two identifiers in the order they are stored
+func contactPair(x string, y string) (string, string) {
+	if y < x {
+		return y, x
+	}
+	return x, y
+}
+
+// returns the other user in the contact
+func (c *Contact) other(identifier string) string {
+	if c.IdentifierA == identifier {
+		return c.IdentifierB
+	}
+	return c.IdentifierA
+}
+
+// returns true if identifier has been asked to be a contact and hasn't
+// answered yet
+func (c *Contact) awaits(identifier string) bool {
+	return c.Status == contactPending && c.RequestedBy != identifier
+}
+
+// a contact as the user sees it
+type ContactView struct {
+	Identifier string `json:"identifier"`
+	// "accepted", or for pending ones "incoming" if the user was asked and
+	// "outgoing" if they asked
+	Status    string    `json:"status"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (c *Contact) viewFor(identifier string) ContactView {
+	status := c.Status
+	if c.awaits(identifier) {
+		status = "incoming"
+	} else if c.Status == contactPending {
+		status = "outgoing"
+	}
+	return ContactView{Identifier: c.other(identifier), Status: status, UpdatedAt: c.UpdatedAt}
+}
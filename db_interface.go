@@ -1,139 +1,865 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-
-	"golang.org/x/crypto/bcrypt"
+	"log"
+	"strings"
+	"time"
 )
 
 // interface that defines the methods needed to interact with database
 // for wellbeing sharing
 type DataSource interface {
-	DoesUserExist(identifier string) (bool, error)
+	DoesUserExist(ctx context.Context, identifier string) (bool, error)
+
+	// gets the stored password digest, or nil if there is no such user
+	GetPasswordDigest(ctx context.Context, identifier string) ([]byte, error)
 
-	// @param password is plaintext
-	isValidPassword(identifier string, password string) (bool, error)
+	// replaces the stored password digest. Returns sql.ErrNoRows if there is
+	// no such user.
+	UpdatePassword(ctx context.Context, identifier string, digest []byte) error
 
 	// inserts the identifier and hashed password digest
-	InsertUser(identifier string, digest []byte) error
+	InsertUser(ctx context.Context, identifier string, digest []byte) error
+
+	// erases the user, every message and nudge they sent or were sent, their
+	// sessions, public keys, contacts, blocks and failed password attempts, in
+	// one transaction. Reports stay for moderators.
+	// Returns sql.ErrNoRows if there is no such user.
+	DeleteUser(ctx context.Context, identifier string) (*DeletionReceipt, error)
+
+	// inserts a message, to be deleted at expiresAt if it hasn't been acked
+	// by then, or never if nil. If overwrite is true, it replaces the message
+	// pending between the same users instead, if there is one, in a single
+	// statement. Only tables with a unique (identifier_from, identifier_to)
+	// index can be overwritten, which is messageTableName.
+	AddMessage(ctx context.Context, tableName string, identifier_from string, identifier_to string,
+		data string, overwrite bool, expiresAt *time.Time) error
+
+	// gets the list of messages sent to this user, leaving out expired ones
+	GetMessages(ctx context.Context, tableName string, identifier string) ([]Message, error)
+
+	// deletes the messages in the table that expired before now, and returns
+	// how many there were
+	DeleteExpiredMessages(ctx context.Context, tableName string, now time.Time) (int64, error)
+
+	// returns how many messages are pending in the table, for all users
+	CountMessages(ctx context.Context, tableName string) (int64, error)
+
+	// deletes the given messages sent to this user and returns how many were
+	// deleted. IDs of messages sent to someone else are ignored.
+	AckMessages(ctx context.Context,
+		tableName string, identifier string, ids []int64) (int64, error)
+
+	// stores a newly issued login session
+	InsertSession(ctx context.Context, session Session) error
+
+	// gets the session with this ID, or nil if there isn't one
+	GetSession(ctx context.Context, id string) (*Session, error)
+
+	// deletes the session with this ID, revoking it
+	DeleteSession(ctx context.Context, id string) error
+
+	// deletes all of the user's sessions and returns how many there were
+	DeleteSessions(ctx context.Context, identifier string) (int64, error)
+
+	// deletes the sessions that expired before now, and returns how many
+	// there were
+	DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error)
+
+	// gets the failed password attempts recorded under key, or nil if there
+	// are none
+	GetLockout(ctx context.Context, key string) (*Lockout, error)
+
+	// passes the failed password attempts recorded under key, with no
+	// failures if there are none, to update and stores what it leaves, all in
+	// one transaction so concurrent updates to a key take turns. A lockout
+	// left with no failures and not locked is deleted.
+	UpdateLockout(ctx context.Context, key string, update func(lockout *Lockout)) error
 
-	// returns true if there is an existing message pending to be sent
-	// between users
-	IsMessagePending(tableName string, identifier_from string, identifier_to string) (bool, error)
+	// stores lockout if nothing is recorded under its key yet. Returns false,
+	// storing nothing, if something is.
+	InsertLockout(ctx context.Context, lockout Lockout) (bool, error)
 
-	// updates if overwrite is true else inserts a new row.
-	// Doesn't check if appropriate row exists in the first place, so check that
-	// if overwriting.
-	AddMessage(tableName string, identifier_from string, identifier_to string,
-		data string, overwrite bool) error
+	// forgets the failed attempts recorded under key. Returns false if there
+	// weren't any.
+	ClearLockout(ctx context.Context, key string) (bool, error)
 
-	// gets the list of messages sent to this user
-	GetMessages(tableName string, identifier string) ([]interface{}, error)
+	// forgets the failed attempts recorded under key if there are exactly
+	// `failures` of them. Returns false if not.
+	ReleaseLockout(ctx context.Context, key string, failures int) (bool, error)
 
-	// deletes the messages sent to this user
-	DeleteMessages(tableName string, identifier string) error
+	// lists everything recorded, most recent failure first
+	ListLockouts(ctx context.Context) ([]Lockout, error)
+
+	// makes key the user's current public key, marking the one it replaces
+	// as replaced at key.CreatedAt
+	AddPublicKey(ctx context.Context, key PublicKey) error
+
+	// gets the user's current public key, or nil if they haven't registered one
+	GetPublicKey(ctx context.Context, identifier string) (*PublicKey, error)
+
+	// lists every key the user has registered, the current one first
+	ListPublicKeys(ctx context.Context, identifier string) ([]PublicKey, error)
+
+	// records that nonce has been used, remembering it until expiresAt.
+	// Returns false if it already was. Expired nonces are forgotten.
+	UseMessageNonce(ctx context.Context, nonce string, expiresAt time.Time) (bool, error)
+
+	// gets the contact between the two users, in either order, or nil if
+	// there isn't one
+	GetContact(ctx context.Context, identifier string, other string) (*Contact, error)
+
+	// stores contact, replacing whatever was recorded for the same pair
+	SaveContact(ctx context.Context, contact Contact) error
+
+	// deletes the contact between the two users. Returns false if there
+	// wasn't one.
+	DeleteContact(ctx context.Context, identifier string, other string) (bool, error)
+
+	// lists the user's contacts, pending or not, most recently updated first
+	ListContacts(ctx context.Context, identifier string) ([]Contact, error)
+
+	// stops blocked sending to blocker. Blocking again changes nothing.
+	BlockUser(ctx context.Context, blocker string, blocked string) error
+
+	// undoes BlockUser. Returns false if blocked wasn't blocked.
+	UnblockUser(ctx context.Context, blocker string, blocked string) (bool, error)
+
+	// returns true if blocker has blocked blocked
+	IsBlocked(ctx context.Context, blocker string, blocked string) (bool, error)
+
+	// stores a new report and returns its ID
+	AddReport(ctx context.Context, report Report) (int64, error)
+
+	// lists the reports that haven't been resolved, oldest first
+	ListOpenReports(ctx context.Context) ([]Report, error)
+
+	// marks a report resolved. Returns false if there is no such open report.
+	ResolveReport(ctx context.Context, id int64) (bool, error)
 }
 
 // new type since we can't implement extensions to the sql.DB type
 type MyDB struct {
 	database *sql.DB
+
+	// longest a single query may take, no limit if 0
+	queryTimeout time.Duration
 }
 
-func (mydb *MyDB) DoesUserExist(identifier string) (bool, error) {
+// bounds ctx by the query timeout
+func (mydb *MyDB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if mydb.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, mydb.queryTimeout)
+}
+
+func (mydb *MyDB) DoesUserExist(ctx context.Context, identifier string) (bool, error) {
 	sqlDB := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
 
 	count := 0
-	err := sqlDB.QueryRow("SELECT COUNT(*) FROM users WHERE identifier = ?",
+	err := sqlDB.QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE identifier = ?",
 		identifier).Scan(&count)
 
 	return count > 0, err
 }
 
-func (mydb *MyDB) InsertUser(identifier string, digest []byte) error {
+func (mydb *MyDB) InsertUser(ctx context.Context, identifier string, digest []byte) error {
 	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
 
-	_, err := db.Exec("INSERT INTO users (identifier, password) VALUES (?, ?)",
+	_, err := db.ExecContext(ctx, "INSERT INTO users (identifier, password) VALUES (?, ?)",
 		identifier, digest)
 	return err
 }
 
-func (mydb *MyDB) IsMessagePending(tableName string,
-	identifier_from string, identifier_to string) (bool, error) {
+func (mydb *MyDB) DeleteUser(ctx context.Context, identifier string) (*DeletionReceipt, error) {
 	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
 
-	count := 0
-	countQuery := "SELECT COUNT(*) FROM " + tableName + " WHERE " +
-		"identifier_from = ? AND identifier_to = ?"
-	err := db.QueryRow(countQuery,
-		identifier_from, identifier_to).Scan(&count)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // no-op once committed
 
-	return count > 0, err
+	// returns how many rows query deleted
+	deleteRows := func(query string, args ...interface{}) (int64, error) {
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	}
+
+	users, err := deleteRows("DELETE FROM users WHERE identifier = ?", identifier)
+	if err != nil {
+		return nil, err
+	} else if users == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	receipt := DeletionReceipt{Identifier: identifier}
+	mailboxes := map[string]*int64{
+		messageTableName: &receipt.Messages,
+		nudgeTableName:   &receipt.Nudges,
+	}
+	for tableName, count := range mailboxes {
+		*count, err = deleteRows("DELETE FROM "+tableName+
+			" WHERE identifier_from = ? OR identifier_to = ?", identifier, identifier)
+		if err != nil {
+			return nil, err
+		}
+	}
+	receipt.Sessions, err = deleteRows("DELETE FROM sessions WHERE identifier = ?", identifier)
+	if err != nil {
+		return nil, err
+	}
+	_, err = deleteRows("DELETE FROM lockouts WHERE lock_key = ?", "id:"+identifier)
+	if err != nil {
+		return nil, err
+	}
+	receipt.Keys, err = deleteRows("DELETE FROM public_keys WHERE identifier = ?", identifier)
+	if err != nil {
+		return nil, err
+	}
+	receipt.Contacts, err = deleteRows(
+		"DELETE FROM contacts WHERE identifier_a = ? OR identifier_b = ?", identifier, identifier)
+	if err != nil {
+		return nil, err
+	}
+	// blocks against them are kept, in case they sign up again
+	receipt.Blocks, err = deleteRows("DELETE FROM blocks WHERE blocker = ?", identifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	receipt.DeletedAt = time.Now().UTC().Truncate(time.Second)
+	return &receipt, nil
 }
 
-func (mydb *MyDB) AddMessage(tableName string,
+func (mydb *MyDB) AddMessage(ctx context.Context, tableName string,
 	identifier_from string, identifier_to string,
-	data string, overwrite bool) error {
+	data string, overwrite bool, expiresAt *time.Time) error {
 	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
 
-	var err error
+	// REPLACE works the same in MySQL and SQLite. The replacement gets a new
+	// ID and created_at, so acking the old one by ID can't delete it.
+	verb := "INSERT"
 	if overwrite {
-		updateQuery := "UPDATE " + tableName + " SET data = ? " +
-			"WHERE identifier_from = ? AND identifier_to = ?"
-		_, err = db.Exec(updateQuery,
-			data, identifier_from, identifier_to)
-	} else {
-		insertQuery := "INSERT INTO " + tableName + " (identifier_from, " +
-			"identifier_to, data) VALUES (?, ?, ?)"
-		_, err = db.Exec(insertQuery,
-			identifier_from, identifier_to, data)
+		verb = "REPLACE"
+	}
+	query := verb + " INTO " + tableName +
+		" (identifier_from, identifier_to, data, expires_at) VALUES (?, ?, ?, ?)"
+	// in UTC, like the times it's compared with, since SQLite compares them as
+	// text
+	if expiresAt != nil {
+		utc := expiresAt.UTC()
+		expiresAt = &utc
 	}
+	_, err := db.ExecContext(ctx, query, identifier_from, identifier_to, data, expiresAt)
 	return err
 }
 
-func (mydb *MyDB) isValidPassword(identifier string, password string) (bool, error) {
+func (mydb *MyDB) GetPasswordDigest(ctx context.Context, identifier string) ([]byte, error) {
 	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
 
 	var stored []byte
-	err := db.QueryRow("SELECT password FROM users WHERE identifier = ? LIMIT 1",
+	err := db.QueryRowContext(ctx, "SELECT password FROM users WHERE identifier = ? LIMIT 1",
 		identifier).Scan(&stored)
-	if err == nil {
-		err := bcrypt.CompareHashAndPassword(stored, []byte(password))
-		return err == nil, err // valid if no error
-	} else {
-		return false, err
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
+	return stored, err
 }
 
-func (mydb *MyDB) GetMessages(tableName string, identifier string) ([]interface{}, error) {
+func (mydb *MyDB) UpdatePassword(ctx context.Context, identifier string, digest []byte) error {
 	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
 
-	query := "SELECT identifier_from, data FROM " + tableName + " WHERE identifier_to = ?"
-	rows, err := db.Query(query, identifier)
+	result, err := db.ExecContext(ctx, "UPDATE users SET password = ? WHERE identifier = ?",
+		digest, identifier)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
 
-	messages := make([]interface{}, 0)
+func (mydb *MyDB) GetMessages(ctx context.Context,
+	tableName string, identifier string) ([]Message, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	// the sweeper may not have got to the expired ones yet
+	query := "SELECT id, identifier_from, created_at, expires_at, data FROM " + tableName +
+		" WHERE identifier_to = ? AND (expires_at IS NULL OR expires_at > ?) ORDER BY created_at, id"
+	rows, err := db.QueryContext(ctx, query, identifier, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]Message, 0)
 	for rows.Next() {
-		var identifier_from string
+		message := Message{Channel: channelNames[tableName]}
+		var expiresAt sql.NullTime
 		var encoded []byte
-		var decoded interface{}
 
-		rows.Scan(&identifier_from, &encoded)
+		err := rows.Scan(&message.ID, &message.Identifier_from, &message.CreatedAt, &expiresAt,
+			&encoded)
+		if err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			message.ExpiresAt = &expiresAt.Time
+		}
 		// query seems to return json strings so I decode here; we may
 		// as well send actual JSON
-		json.Unmarshal(encoded, &decoded)
+		if err := json.Unmarshal(encoded, &message.Data); err != nil {
+			// still returned as is, so the client can see it and ack it
+			log.Printf("malformed message %d in %s: %v", message.ID, tableName, err)
+			message.Data = string(encoded)
+			message.Malformed = true
+		}
 
-		messages = append(messages,
-			map[string]interface{}{"identifier_from": identifier_from, "data": decoded})
+		messages = append(messages, message)
 	}
 
-	return messages, err
+	return messages, rows.Err()
+}
+
+func (mydb *MyDB) CountMessages(ctx context.Context, tableName string) (int64, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	var count int64
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+tableName).Scan(&count)
+	return count, err
 }
 
-func (mydb *MyDB) DeleteMessages(tableName string, identifier string) error {
+func (mydb *MyDB) DeleteExpiredMessages(ctx context.Context,
+	tableName string, now time.Time) (int64, error) {
 	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "DELETE FROM "+tableName+" WHERE expires_at <= ?", now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
 
-	queryDelete := "DELETE FROM " + tableName + " WHERE identifier_to = ?"
-	_, err := db.Exec(queryDelete, identifier)
+func (mydb *MyDB) AckMessages(ctx context.Context,
+	tableName string, identifier string, ids []int64) (int64, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	args := make([]interface{}, 0, len(ids)+1)
+	args = append(args, identifier)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+
+	queryDelete := "DELETE FROM " + tableName + " WHERE identifier_to = ? AND id IN (" +
+		placeholders + ")"
+	result, err := db.ExecContext(ctx, queryDelete, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (mydb *MyDB) InsertSession(ctx context.Context, session Session) error {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO sessions (id, identifier, expires_at) VALUES (?, ?, ?)",
+		session.ID, session.Identifier, session.ExpiresAt.UTC())
+	return err
+}
+
+func (mydb *MyDB) GetSession(ctx context.Context, id string) (*Session, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	session := Session{ID: id}
+	err := db.QueryRowContext(ctx, "SELECT identifier, expires_at FROM sessions WHERE id = ?",
+		id).Scan(&session.Identifier, &session.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (mydb *MyDB) DeleteSession(ctx context.Context, id string) error {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
 
+	_, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE id = ?", id)
 	return err
 }
+
+func (mydb *MyDB) DeleteSessions(ctx context.Context, identifier string) (int64, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE identifier = ?", identifier)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (mydb *MyDB) DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at < ?", now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (mydb *MyDB) GetLockout(ctx context.Context, key string) (*Lockout, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	lockout := Lockout{Key: key}
+	var lockedUntil sql.NullTime
+	err := db.QueryRowContext(ctx,
+		"SELECT failures, last_failure, locked_until FROM lockouts WHERE lock_key = ?",
+		key).Scan(&lockout.Failures, &lockout.LastFailure, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if lockedUntil.Valid {
+		lockout.LockedUntil = &lockedUntil.Time
+	}
+	return &lockout, nil
+}
+
+func (mydb *MyDB) UpdateLockout(ctx context.Context, key string,
+	update func(lockout *Lockout)) error {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	// make sure there is a row to lock, so updates to a new key wait for each
+	// other too
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO lockouts (lock_key, failures, last_failure) VALUES (?, 0, ?)",
+		key, time.Now().UTC())
+	if err != nil && !isDuplicateKey(err) {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	// locks the row until we commit
+	_, err = tx.ExecContext(ctx, "UPDATE lockouts SET failures = failures WHERE lock_key = ?", key)
+	if err != nil {
+		return err
+	}
+	lockout := Lockout{Key: key}
+	var lockedUntil sql.NullTime
+	err = tx.QueryRowContext(ctx,
+		"SELECT failures, last_failure, locked_until FROM lockouts WHERE lock_key = ?",
+		key).Scan(&lockout.Failures, &lockout.LastFailure, &lockedUntil)
+	if err != nil && err != sql.ErrNoRows {
+		// no rows if it was cleared since we made sure of it, which is the
+		// same as no failures
+		return err
+	}
+	if lockedUntil.Valid {
+		lockout.LockedUntil = &lockedUntil.Time
+	}
+
+	update(&lockout)
+	if lockout.Failures <= 0 && lockout.LockedUntil == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM lockouts WHERE lock_key = ?", key)
+	} else {
+		// REPLACE works the same in MySQL and SQLite
+		_, err = tx.ExecContext(ctx,
+			"REPLACE INTO lockouts (lock_key, failures, last_failure, locked_until) VALUES (?, ?, ?, ?)",
+			key, lockout.Failures, lockout.LastFailure, lockout.LockedUntil)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (mydb *MyDB) InsertLockout(ctx context.Context, lockout Lockout) (bool, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO lockouts (lock_key, failures, last_failure, locked_until) VALUES (?, ?, ?, ?)",
+		lockout.Key, lockout.Failures, lockout.LastFailure, lockout.LockedUntil)
+	if isDuplicateKey(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (mydb *MyDB) ReleaseLockout(ctx context.Context, key string, failures int) (bool, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx,
+		"DELETE FROM lockouts WHERE lock_key = ? AND failures = ?", key, failures)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (mydb *MyDB) ClearLockout(ctx context.Context, key string) (bool, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "DELETE FROM lockouts WHERE lock_key = ?", key)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (mydb *MyDB) ListLockouts(ctx context.Context) ([]Lockout, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT lock_key, failures, last_failure, locked_until FROM lockouts ORDER BY last_failure DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := make([]Lockout, 0)
+	for rows.Next() {
+		var lockout Lockout
+		var lockedUntil sql.NullTime
+		err := rows.Scan(&lockout.Key, &lockout.Failures, &lockout.LastFailure, &lockedUntil)
+		if err != nil {
+			return nil, err
+		}
+		if lockedUntil.Valid {
+			lockout.LockedUntil = &lockedUntil.Time
+		}
+		lockouts = append(lockouts, lockout)
+	}
+	return lockouts, rows.Err()
+}
+
+func (mydb *MyDB) AddPublicKey(ctx context.Context, key PublicKey) error {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op once committed
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE public_keys SET replaced_at = ? WHERE identifier = ? AND replaced_at IS NULL",
+		key.CreatedAt, key.Identifier)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO public_keys (identifier, pem, fingerprint, created_at) VALUES (?, ?, ?, ?)",
+		key.Identifier, key.PEM, key.Fingerprint, key.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (mydb *MyDB) GetPublicKey(ctx context.Context, identifier string) (*PublicKey, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	key := PublicKey{Identifier: identifier}
+	err := db.QueryRowContext(ctx, "SELECT pem, fingerprint, created_at FROM public_keys "+
+		"WHERE identifier = ? AND replaced_at IS NULL ORDER BY id DESC LIMIT 1",
+		identifier).Scan(&key.PEM, &key.Fingerprint, &key.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (mydb *MyDB) ListPublicKeys(ctx context.Context, identifier string) ([]PublicKey, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT pem, fingerprint, created_at, replaced_at "+
+		"FROM public_keys WHERE identifier = ? ORDER BY id DESC", identifier)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]PublicKey, 0)
+	for rows.Next() {
+		key := PublicKey{Identifier: identifier}
+		var replacedAt sql.NullTime
+		err := rows.Scan(&key.PEM, &key.Fingerprint, &key.CreatedAt, &replacedAt)
+		if err != nil {
+			return nil, err
+		}
+		if replacedAt.Valid {
+			key.ReplacedAt = &replacedAt.Time
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (mydb *MyDB) UseMessageNonce(ctx context.Context,
+	nonce string, expiresAt time.Time) (bool, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "DELETE FROM message_nonces WHERE expires_at < ?",
+		time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO message_nonces (nonce, expires_at) VALUES (?, ?)",
+		nonce, expiresAt.UTC())
+	if isDuplicateKey(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (mydb *MyDB) GetContact(ctx context.Context,
+	identifier string, other string) (*Contact, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	var contact Contact
+	contact.IdentifierA, contact.IdentifierB = contactPair(identifier, other)
+	err := db.QueryRowContext(ctx, "SELECT requested_by, status, updated_at FROM contacts "+
+		"WHERE identifier_a = ? AND identifier_b = ?", contact.IdentifierA, contact.IdentifierB).
+		Scan(&contact.RequestedBy, &contact.Status, &contact.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &contact, nil
+}
+
+func (mydb *MyDB) SaveContact(ctx context.Context, contact Contact) error {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "REPLACE INTO contacts "+
+		"(identifier_a, identifier_b, requested_by, status, updated_at) VALUES (?, ?, ?, ?, ?)",
+		contact.IdentifierA, contact.IdentifierB, contact.RequestedBy, contact.Status,
+		contact.UpdatedAt)
+	return err
+}
+
+func (mydb *MyDB) DeleteContact(ctx context.Context, identifier string, other string) (bool, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	a, b := contactPair(identifier, other)
+	result, err := db.ExecContext(ctx,
+		"DELETE FROM contacts WHERE identifier_a = ? AND identifier_b = ?", a, b)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (mydb *MyDB) ListContacts(ctx context.Context, identifier string) ([]Contact, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT identifier_a, identifier_b, requested_by, status, "+
+		"updated_at FROM contacts WHERE identifier_a = ? OR identifier_b = ? "+
+		"ORDER BY updated_at DESC", identifier, identifier)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contacts := make([]Contact, 0)
+	for rows.Next() {
+		var contact Contact
+		err := rows.Scan(&contact.IdentifierA, &contact.IdentifierB, &contact.RequestedBy,
+			&contact.Status, &contact.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, rows.Err()
+}
+
+func (mydb *MyDB) BlockUser(ctx context.Context, blocker string, blocked string) error {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO blocks (blocker, blocked, created_at) VALUES (?, ?, ?)",
+		blocker, blocked, time.Now().UTC().Truncate(time.Second))
+	if isDuplicateKey(err) {
+		return nil
+	}
+	return err
+}
+
+func (mydb *MyDB) UnblockUser(ctx context.Context, blocker string, blocked string) (bool, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "DELETE FROM blocks WHERE blocker = ? AND blocked = ?",
+		blocker, blocked)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (mydb *MyDB) IsBlocked(ctx context.Context, blocker string, blocked string) (bool, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	count := 0
+	err := db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM blocks WHERE blocker = ? AND blocked = ?",
+		blocker, blocked).Scan(&count)
+	return count > 0, err
+}
+
+func (mydb *MyDB) AddReport(ctx context.Context, report Report) (int64, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "INSERT INTO reports "+
+		"(reporter, reported, channel, message_id, message_data, reason, created_at) "+
+		"VALUES (?, ?, ?, ?, ?, ?, ?)",
+		report.Reporter, report.Reported, report.Channel, report.MessageID, report.Data,
+		report.Reason, report.CreatedAt)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (mydb *MyDB) ListOpenReports(ctx context.Context) ([]Report, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT id, reporter, reported, channel, message_id, "+
+		"message_data, reason, created_at FROM reports WHERE resolved_at IS NULL ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := make([]Report, 0)
+	for rows.Next() {
+		var report Report
+		var data sql.NullString // reported before it was kept
+		err := rows.Scan(&report.ID, &report.Reporter, &report.Reported, &report.Channel,
+			&report.MessageID, &data, &report.Reason, &report.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		report.Data = data.String
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+func (mydb *MyDB) ResolveReport(ctx context.Context, id int64) (bool, error) {
+	db := mydb.database
+	ctx, cancel := mydb.withTimeout(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx,
+		"UPDATE reports SET resolved_at = ? WHERE id = ? AND resolved_at IS NULL",
+		time.Now().UTC().Truncate(time.Second), id)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
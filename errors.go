@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo/v4"
+)
+
+// stable, machine readable reasons a request failed. The app matches on
+// these, so don't change the strings.
+const (
+	codeNotFound           = "not_found"
+	codeInvalidCredentials = "invalid_credentials"
+	codeConflict           = "conflict"
+	codeValidation         = "validation"
+	codeForbidden          = "forbidden"
+	codeRateLimited        = "rate_limited"
+	codeLockedOut          = "locked_out"
+	codeInternal           = "internal"
+)
+
+// an error we can show the client, as `{"success": false, "reason", "code"}`,
+// plus "fields" if set
+type APIError struct {
+	Code   string
+	Reason string
+
+	// what is wrong with each field of the request, for validation errors
+	Fields map[string]string
+
+	// what actually went wrong, for the logs only
+	Err error
+
+	// overrides the status the code implies, for errors Echo raised itself
+	httpStatus int
+
+	// sent as Retry-After, if set
+	retryAfter time.Duration
+}
+
+func newAPIError(code string, reason string) *APIError {
+	return &APIError{Code: code, Reason: reason}
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Reason, e.Err)
+	}
+	return e.Code + ": " + e.Reason
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// the HTTP status to respond with.
+//
+// Released app builds treat any 400 as "failed, show the reason", so the codes
+// failStatus was already used for keep that status.
+func (e *APIError) status() int {
+	if e.httpStatus != 0 {
+		return e.httpStatus
+	}
+	switch e.Code {
+	case codeNotFound:
+		return http.StatusNotFound
+	case codeForbidden:
+		return http.StatusForbidden
+	case codeRateLimited, codeLockedOut:
+		return http.StatusTooManyRequests
+	case codeInternal:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// failures handlers report often
+var (
+	errBadPassword = newAPIError(codeInvalidCredentials, "Password doesn't match expected.")
+	errBadSession  = newAPIError(codeInvalidCredentials, "Session is invalid or expired.")
+)
+
+// turns any error a handler returns into an APIError. Store failures we
+// recognise get their own code, anything else is internal.
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		reason := http.StatusText(httpErr.Code)
+		if message, ok := httpErr.Message.(string); ok {
+			reason = message
+		}
+		code := codeInternal
+		switch {
+		case httpErr.Code == http.StatusNotFound || httpErr.Code == http.StatusMethodNotAllowed:
+			code = codeNotFound
+		case httpErr.Code == http.StatusUnauthorized || httpErr.Code == http.StatusForbidden:
+			code = codeInvalidCredentials
+		case httpErr.Code == http.StatusTooManyRequests:
+			code = codeRateLimited
+		case httpErr.Code < http.StatusInternalServerError:
+			// e.g. a body Bind couldn't parse
+			code = codeValidation
+		}
+		return &APIError{Code: code, Reason: reason, Err: err, httpStatus: httpErr.Code}
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return &APIError{Code: codeNotFound, Reason: "Not found.", Err: err}
+	}
+	if isDuplicateKey(err) {
+		return &APIError{Code: codeConflict, Reason: "Already exists.", Err: err}
+	}
+	return &APIError{Code: codeInternal, Reason: "Something went wrong, please try again later.",
+		Err: err}
+}
+
+// returns true if err is a unique constraint violation, from either database
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1062 // ER_DUP_ENTRY
+	}
+	return isSQLiteDuplicateKey(err)
+}
+
+// Echo's HTTPErrorHandler: responds to errors returned by handlers with the
+// same envelope failStatus writes, without leaking internal details
+func handleHTTPError(err error, c echo.Context) {
+	apiErr := toAPIError(err)
+	if apiErr.Code == codeInternal {
+		log.Print(err)
+	}
+	if c.Response().Committed {
+		return
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(apiErr.status())
+	} else {
+		err = failStatus(c, apiErr)
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
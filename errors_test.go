@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// runs handleHTTPError for err and returns the response
+func recordHTTPError(err error) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	rec := httptest.NewRecorder()
+	handleHTTPError(err, echo.New().NewContext(req, rec))
+	return rec
+}
+
+func TestHTTPErrorHidesInternalErrors(t *testing.T) {
+	rec := recordHTTPError(errors.New("dial tcp 178.79.172.202:3306: connection refused"))
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"internal"`)
+	assert.Contains(t, rec.Body.String(), `"success":false`)
+	assert.NotContains(t, rec.Body.String(), "178.79.172.202")
+}
+
+func TestHTTPErrorBindFailure(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{not json"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	err := e.NewContext(req, httptest.NewRecorder()).Bind(new(User))
+
+	rec := recordHTTPError(err)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"validation"`)
+}
+
+func TestHTTPErrorDuplicateKey(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+	assert.NoError(t, db.InsertUser(ctx, "user", []byte("digest")))
+	err := db.InsertUser(ctx, "user", []byte("digest"))
+
+	rec := recordHTTPError(err)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"conflict"`)
+}
+
+func TestAPIErrorStatus(t *testing.T) {
+	assert.Equal(t, http.StatusBadRequest, errBadPassword.status())
+	assert.Equal(t, http.StatusNotFound, newAPIError(codeNotFound, "").status())
+	assert.Equal(t, http.StatusForbidden, newAPIError(codeForbidden, "").status())
+	assert.Equal(t, http.StatusTooManyRequests, newAPIError(codeRateLimited, "").status())
+}
+
+func TestHTTPErrorRetryAfter(t *testing.T) {
+	rec := recordHTTPError(lockedOutError(90*time.Second + time.Millisecond))
+
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "91", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), `"code":"locked_out"`)
+}
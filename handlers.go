@@ -1,24 +1,42 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"log"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
-	"golang.org/x/crypto/bcrypt"
 )
 
-// checks if user exists
-func handleCheckUser(db DataSource) func(echo.Context) error {
+// checks if user exists.
+//
+// If requireProof is set, anyone can't just ask: the request needs a session
+// token, the identifier's own password, or an invite the user made.
+func handleCheckUser(db DataSource, sm *SessionManager,
+	requireProof bool) func(echo.Context) error {
 	return func(c echo.Context) error {
-		user := new(User)
+		user := new(CheckUserJSON)
 		// bind the parameters into the User object
 		if err := c.Bind(user); err != nil {
 			return err
 		}
 
-		exists, err := db.DoesUserExist(user.Identifier)
+		if requireProof {
+			proven, err := proveLookup(c, db, sm, user)
+			if err != nil {
+				return err
+			} else if !proven {
+				return failStatus(c, newAPIError(codeInvalidCredentials,
+					"Log in, or use an invite, to look up users."))
+			}
+		}
+
+		exists, err := db.DoesUserExist(c.Request().Context(), user.Identifier)
 		if err != nil {
 			return err
 		}
@@ -28,55 +46,661 @@ func handleCheckUser(db DataSource) func(echo.Context) error {
 	}
 }
 
-// adds a user to the database if the identifier is unused
-func handleAddUser(db DataSource) func(echo.Context) error {
+// returns true if the request has a right to know whether user.Identifier
+// exists. A session only covers its own identifier and its contacts', or one
+// account would be enough to check every identifier.
+func proveLookup(c echo.Context, db DataSource, sm *SessionManager, user *CheckUserJSON) (bool, error) {
+	ctx := c.Request().Context()
+	if token, ok := bearerToken(c); ok {
+		session, err := sm.Verify(ctx, token)
+		if err != nil || session == nil {
+			return false, err
+		} else if session.Identifier == user.Identifier {
+			return true, nil
+		}
+		contact, err := db.GetContact(ctx, session.Identifier, user.Identifier)
+		return contact != nil, err
+	}
+	if user.Invite != "" {
+		return sm.VerifyInvite(user.Invite, user.Identifier), nil
+	}
+	if user.Password != "" {
+		return sm.checkPassword(ctx, c.RealIP(), user.Identifier, user.Password)
+	}
+	return false, nil
+}
+
+// makes an invite for the user to hand out, e.g. in their add friend link,
+// which lets whoever has it check that they exist
+func handleInvite(sm *SessionManager) func(echo.Context) error {
 	return func(c echo.Context) error {
 		user := new(User)
 		if err := c.Bind(user); err != nil {
 			return err
 		}
 
+		identifier, err := sm.authenticate(c, user.Identifier, user.Password)
+		if err != nil {
+			return err
+		} else if identifier == "" {
+			return failStatus(c, errBadPassword)
+		}
+
+		invite, expiresAt := sm.IssueInvite(identifier)
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": true, "invite": invite, "expires_at": expiresAt})
+	}
+}
+
+// adds a user to the database if the identifier is unused.
+//
+// With requireProof, the reason a taken identifier is refused is kept vague;
+// it can't be hidden completely, but signing up is rate limited.
+func handleAddUser(db DataSource, hasher *passwordHasher,
+	requireProof bool) func(echo.Context) error {
+	return func(c echo.Context) error {
+		user := new(User)
+		if err := c.Bind(user); err != nil {
+			return err
+		}
+		if apiErr := validationError(map[string]string{
+			"identifier": validateIdentifier(user.Identifier),
+			"password":   validatePassword(user.Identifier, user.Password),
+		}); apiErr != nil {
+			return failStatus(c, apiErr)
+		}
+
 		// ensure identifier is not already in use
-		exists, err := db.DoesUserExist(user.Identifier)
+		exists, err := db.DoesUserExist(c.Request().Context(), user.Identifier)
 		if err != nil {
 			return err
+		} else if exists && requireProof {
+			return failStatus(c, newAPIError(codeConflict,
+				"Can't sign up with that identifier, please choose another."))
 		} else if exists {
-			return failStatus(c, "Identifier already exists.")
+			return failStatus(c, newAPIError(codeConflict, "Identifier already exists."))
 		}
 
 		// hash plaintext password (which is secure thanks to HTTPS)
-		digest, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		digest, err := hasher.hash(user.Password)
+		if err != nil {
+			return err
+		}
+		err = db.InsertUser(c.Request().Context(), user.Identifier, digest)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]bool{"success": true})
+	}
+}
+
+// changes a user's password. The current password is needed even if there is
+// a session token. All of the user's sessions are revoked, and a new token is
+// returned in place of the one the client had.
+func handleChangePassword(db DataSource, sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		change := new(ChangePasswordJSON)
+		if err := c.Bind(change); err != nil {
+			return err
+		}
+		if apiErr := validationError(map[string]string{
+			"new_password": validatePassword(change.Identifier, change.NewPassword),
+		}); apiErr != nil {
+			return failStatus(c, apiErr)
+		}
+
+		ctx := c.Request().Context()
+		valid, err := sm.checkPassword(ctx, c.RealIP(), change.Identifier, change.Password)
+		if err != nil {
+			return err
+		} else if !valid {
+			return failStatus(c, errBadPassword)
+		}
+
+		digest, err := sm.hasher.hash(change.NewPassword)
+		if err != nil {
+			return err
+		}
+		if err := db.UpdatePassword(ctx, change.Identifier, digest); err != nil {
+			return err
+		}
+		// anyone who had the old password may have logged in with it
+		if _, err := db.DeleteSessions(ctx, change.Identifier); err != nil {
+			return err
+		}
+
+		token, expiresAt, err := sm.Issue(ctx, change.Identifier)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": true, "token": token, "expires_at": expiresAt})
+	}
+}
+
+// erases a user's account and mailbox data, for when they ask us to.
+// Responds with a receipt of what was deleted.
+func handleDeleteUser(db DataSource, sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		user := new(User)
+		if err := c.Bind(user); err != nil {
+			return err
+		}
+
+		identifier, err := sm.authenticate(c, user.Identifier, user.Password)
+		if err != nil {
+			return err
+		} else if identifier == "" {
+			return failStatus(c, errBadPassword)
+		}
+
+		receipt, err := db.DeleteUser(c.Request().Context(), identifier)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK,
+			map[string]interface{}{"success": true, "receipt": receipt})
+	}
+}
+
+// registers the user's RSA public key, replacing their current one if it
+// differs. Registering the current key again changes nothing.
+func handleRegisterKey(db DataSource, sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		register := new(RegisterKeyJSON)
+		if err := c.Bind(register); err != nil {
+			return err
+		}
+
+		identifier, err := sm.authenticate(c, register.Identifier, register.Password)
+		if err != nil {
+			return err
+		} else if identifier == "" {
+			return failStatus(c, errBadPassword)
+		}
+
+		key, err := newPublicKey(identifier, register.Key)
+		if err != nil {
+			return err
+		}
+		ctx := c.Request().Context()
+		current, err := db.GetPublicKey(ctx, identifier)
+		if err != nil {
+			return err
+		}
+		if current != nil && current.Fingerprint == key.Fingerprint {
+			key = current
+		} else if err := db.AddPublicKey(ctx, *key); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{"success": true, "key": key})
+	}
+}
+
+// gets the user's current public key and its fingerprint
+func handleGetKey(db DataSource, sm *SessionManager, requireProof bool) func(echo.Context) error {
+	return func(c echo.Context) error {
+		identifier, err := keyLookup(c, db, sm, requireProof)
+		if err != nil {
+			return err
+		}
+
+		key, err := db.GetPublicKey(c.Request().Context(), identifier)
+		if err != nil {
+			return err
+		} else if key == nil {
+			return failStatus(c, newAPIError(codeNotFound, "No key is registered for that identifier."))
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{"success": true, "key": key})
+	}
+}
+
+// lists every key the user has registered, so friends can tell if the key
+// they have was replaced
+func handleKeyHistory(db DataSource, sm *SessionManager,
+	requireProof bool) func(echo.Context) error {
+	return func(c echo.Context) error {
+		identifier, err := keyLookup(c, db, sm, requireProof)
+		if err != nil {
+			return err
+		}
+
+		keys, err := db.ListPublicKeys(c.Request().Context(), identifier)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{"success": true, "keys": keys})
+	}
+}
+
+// returns the identifier a key lookup is for, taken from the query. With
+// requireProof it needs the same proof as handleCheckUser, a session token or
+// an invite; passwords don't belong in URLs.
+func keyLookup(c echo.Context, db DataSource, sm *SessionManager, requireProof bool) (string, error) {
+	lookup := &CheckUserJSON{
+		Identifier: c.QueryParam("identifier"),
+		Invite:     c.QueryParam("invite"),
+	}
+	if requireProof {
+		proven, err := proveLookup(c, db, sm, lookup)
+		if err != nil {
+			return "", err
+		} else if !proven {
+			return "", newAPIError(codeInvalidCredentials,
+				"Log in, or use an invite, to look up keys.")
+		}
+	}
+	return lookup.Identifier, nil
+}
+
+// lists the user's contacts, including pending requests
+func handleListContacts(db DataSource, sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		user := new(User)
+		if err := c.Bind(user); err != nil {
+			return err
+		}
+
+		identifier, err := sm.authenticate(c, user.Identifier, user.Password)
+		if err != nil {
+			return err
+		} else if identifier == "" {
+			return failStatus(c, errBadPassword)
+		}
+
+		contacts, err := db.ListContacts(c.Request().Context(), identifier)
+		if err != nil {
+			return err
+		}
+		views := make([]ContactView, len(contacts))
+		for i, contact := range contacts {
+			views[i] = contact.viewFor(identifier)
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{"success": true, "contacts": views})
+	}
+}
+
+// asks another user to be a contact. If they already asked the user, they
+// become contacts straight away.
+func handleContactRequest(db DataSource, sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		identifier, other, err := bindContact(c, sm)
+		if err != nil {
+			return err
+		}
+		ctx := c.Request().Context()
+		if other == identifier {
+			return failStatus(c, validationError(map[string]string{
+				"contact": "You can't add yourself as a contact."}))
+		}
+		if exists, err := db.DoesUserExist(ctx, other); err != nil {
+			return err
+		} else if !exists {
+			return failStatus(c, newAPIError(codeNotFound, "No user with that identifier."))
+		}
+		if blocked, err := db.IsBlocked(ctx, other, identifier); err != nil {
+			return err
+		} else if blocked {
+			return failStatus(c, errBlocked)
+		}
+
+		contact, err := db.GetContact(ctx, identifier, other)
+		if err != nil {
+			return err
+		}
+		// if the user already asked, or they are already contacts, there is
+		// nothing to change
+		if contact == nil {
+			request := newContact(identifier, other)
+			contact = &request
+			err = db.SaveContact(ctx, *contact)
+		} else if contact.awaits(identifier) {
+			contact.Status = contactAccepted
+			contact.UpdatedAt = time.Now().UTC().Truncate(time.Second)
+			err = db.SaveContact(ctx, *contact)
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": true, "contact": contact.viewFor(identifier)})
+	}
+}
+
+// accepts another user's contact request
+func handleContactAccept(db DataSource, sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		identifier, other, err := bindContact(c, sm)
+		if err != nil {
+			return err
+		}
+		ctx := c.Request().Context()
+
+		contact, err := db.GetContact(ctx, identifier, other)
+		if err != nil {
+			return err
+		} else if contact == nil || !contact.awaits(identifier) {
+			return failStatus(c, errNoContactRequest)
+		}
+		contact.Status = contactAccepted
+		contact.UpdatedAt = time.Now().UTC().Truncate(time.Second)
+		if err := db.SaveContact(ctx, *contact); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": true, "contact": contact.viewFor(identifier)})
+	}
+}
+
+// declines another user's contact request. They aren't told, and can ask
+// again.
+func handleContactDecline(db DataSource, sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		identifier, other, err := bindContact(c, sm)
+		if err != nil {
+			return err
+		}
+		ctx := c.Request().Context()
+
+		contact, err := db.GetContact(ctx, identifier, other)
+		if err != nil {
+			return err
+		} else if contact == nil || !contact.awaits(identifier) {
+			return failStatus(c, errNoContactRequest)
+		}
+		if _, err := db.DeleteContact(ctx, identifier, other); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]bool{"success": true})
+	}
+}
+
+// removes a contact, or withdraws a request the user made. Either of them
+// can remove an accepted contact.
+func handleContactRemove(db DataSource, sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		identifier, other, err := bindContact(c, sm)
+		if err != nil {
+			return err
+		}
+
+		deleted, err := db.DeleteContact(c.Request().Context(), identifier, other)
+		if err != nil {
+			return err
+		} else if !deleted {
+			return failStatus(c, newAPIError(codeNotFound, "Not a contact."))
+		}
+
+		return c.JSON(http.StatusOK, map[string]bool{"success": true})
+	}
+}
+
+var errNoContactRequest = newAPIError(codeNotFound, "No contact request from that user.")
+
+// stops someone blocked sending, or asking to be a contact
+var errBlocked = newAPIError(codeForbidden, "You can't send to this user.")
+
+// reads a ContactJSON body, returning the authenticated user and the contact
+// the request is about
+func bindContact(c echo.Context, sm *SessionManager) (string, string, error) {
+	request := new(ContactJSON)
+	if err := c.Bind(request); err != nil {
+		return "", "", err
+	}
+
+	identifier, err := sm.authenticate(c, request.Identifier, request.Password)
+	if err != nil {
+		return "", "", err
+	} else if identifier == "" {
+		return "", "", errBadPassword
+	}
+	return identifier, request.Contact, nil
+}
+
+// blocks a user from sending to this one, removing them as a contact
+func handleBlock(db DataSource, sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		request := new(BlockJSON)
+		if err := c.Bind(request); err != nil {
+			return err
+		}
+
+		identifier, err := sm.authenticate(c, request.Identifier, request.Password)
+		if err != nil {
+			return err
+		} else if identifier == "" {
+			return failStatus(c, errBadPassword)
+		}
+		if request.Blocked == "" || request.Blocked == identifier {
+			return failStatus(c, validationError(map[string]string{
+				"blocked": "Say who to block, other than yourself."}))
+		}
+
+		ctx := c.Request().Context()
+		if err := db.BlockUser(ctx, identifier, request.Blocked); err != nil {
+			return err
+		}
+		if _, err := db.DeleteContact(ctx, identifier, request.Blocked); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]bool{"success": true})
+	}
+}
+
+// lets a blocked user send again. They aren't made a contact again.
+func handleUnblock(db DataSource, sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		request := new(BlockJSON)
+		if err := c.Bind(request); err != nil {
+			return err
+		}
+
+		identifier, err := sm.authenticate(c, request.Identifier, request.Password)
+		if err != nil {
+			return err
+		} else if identifier == "" {
+			return failStatus(c, errBadPassword)
+		}
+
+		unblocked, err := db.UnblockUser(c.Request().Context(), identifier, request.Blocked)
+		if err != nil {
+			return err
+		} else if !unblocked {
+			return failStatus(c, newAPIError(codeNotFound, "That user isn't blocked."))
+		}
+
+		return c.JSON(http.StatusOK, map[string]bool{"success": true})
+	}
+}
+
+// records a report of a message or nudge the user was sent, for moderators
+// to review with `nudgeme reports list`. The message must still be pending in
+// the user's mailbox, and its data is kept with the report.
+func handleReport(db DataSource, sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		request := new(ReportJSON)
+		if err := c.Bind(request); err != nil {
+			return err
+		}
+
+		identifier, err := sm.authenticate(c, request.Identifier, request.Password)
+		if err != nil {
+			return err
+		} else if identifier == "" {
+			return failStatus(c, errBadPassword)
+		}
+		if apiErr := validationError(validateReport(request)); apiErr != nil {
+			return failStatus(c, apiErr)
+		}
+
+		message, err := findReportedMessage(c.Request().Context(), db, identifier, request)
+		if err != nil {
+			return err
+		} else if message == nil {
+			return failStatus(c, newAPIError(codeNotFound,
+				"No pending message with that id from that user."))
+		}
+		var data []byte
+		if message.Malformed {
+			data = []byte(message.Data.(string))
+		} else if data, err = json.Marshal(message.Data); err != nil {
+			return err
+		}
+
+		id, err := db.AddReport(c.Request().Context(), Report{
+			Reporter:  identifier,
+			Reported:  request.Reported,
+			Channel:   request.Channel,
+			MessageID: request.MessageID,
+			Data:      string(data),
+			Reason:    request.Reason,
+			CreatedAt: time.Now().UTC().Truncate(time.Second),
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("report %d: %s reported %s %d from %s", id, identifier,
+			request.Channel, request.MessageID, request.Reported)
+
+		return c.JSON(http.StatusOK, map[string]interface{}{"success": true, "report_id": id})
+	}
+}
+
+// returns the message report names from identifier's mailbox, or nil if it
+// isn't there
+func findReportedMessage(ctx context.Context, db DataSource, identifier string,
+	report *ReportJSON) (*Message, error) {
+	for tableName, channel := range channelNames {
+		if channel != report.Channel {
+			continue
+		}
+		messages, err := db.GetMessages(ctx, tableName, identifier)
+		if err != nil {
+			return nil, err
+		}
+		for i := range messages {
+			if messages[i].ID == report.MessageID && messages[i].Identifier_from == report.Reported {
+				return &messages[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// logs a user in, returning a session token to use in place of the password
+func handleLogin(sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		user := new(User)
+		if err := c.Bind(user); err != nil {
+			return err
+		}
+
+		valid, err := sm.checkPassword(c.Request().Context(), c.RealIP(),
+			user.Identifier, user.Password)
+		if err != nil {
+			return err
+		} else if !valid {
+			return failStatus(c, errBadPassword)
+		}
+
+		token, expiresAt, err := sm.Issue(c.Request().Context(), user.Identifier)
 		if err != nil {
 			return err
 		}
-		err = db.InsertUser(user.Identifier, digest)
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": true, "token": token, "expires_at": expiresAt})
+	}
+}
+
+// swaps the session token in the Authorization header for a new one
+func handleRefreshSession(sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		token, _ := bearerToken(c)
+		newToken, expiresAt, err := sm.Refresh(c.Request().Context(), token)
 		if err != nil {
 			return err
+		} else if newToken == "" {
+			return failStatus(c, errBadSession)
+		}
+
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"success": true, "token": newToken, "expires_at": expiresAt})
+	}
+}
+
+// revokes the session token in the Authorization header
+func handleLogout(sm *SessionManager) func(echo.Context) error {
+	return func(c echo.Context) error {
+		token, _ := bearerToken(c)
+		revoked, err := sm.Revoke(c.Request().Context(), token)
+		if err != nil {
+			return err
+		} else if !revoked {
+			return failStatus(c, errBadSession)
 		}
 
 		return c.JSON(http.StatusOK, map[string]bool{"success": true})
 	}
 }
 
+// what a new message must satisfy to be delivered, besides the sender's
+// password or session
+type messageRules struct {
+	// must be signed, see checkMessageSignature
+	requireSignature bool
+	// sender and recipient must be accepted contacts
+	requireContacts bool
+}
+
 // handles request to submit data to another user.
 //
 // If overwrite is false, it will not overwrite data between User A and User B.
-func handleNewMessage(db DataSource, tableName string, overwrite bool) func(echo.Context) error {
+// Messages not acked within ttl are deleted, 0 keeps them until they are.
+func handleNewMessage(db DataSource, sm *SessionManager, tableName string, overwrite bool,
+	ttl time.Duration, rules messageRules) func(echo.Context) error {
 	return func(c echo.Context) error {
 		newMessage := new(NewMessageJSON)
 		if err := c.Bind(newMessage); err != nil {
 			return err
 		}
 
-		valid, err := db.isValidPassword(newMessage.Identifier_from, newMessage.Password)
+		identifier, err := sm.authenticate(c, newMessage.Identifier_from, newMessage.Password)
 		if err != nil {
 			return err
-		} else if !valid {
-			return failStatus(c, "Password doesn't match expected.")
+		} else if identifier == "" {
+			return failStatus(c, errBadPassword)
 		}
+		newMessage.Identifier_from = identifier
 
-		isPending, err := db.IsMessagePending(tableName, newMessage.Identifier_from,
-			newMessage.Identifier_to)
+		blocked, err := db.IsBlocked(c.Request().Context(), newMessage.Identifier_to, identifier)
+		if err != nil {
+			return err
+		} else if blocked {
+			return failStatus(c, errBlocked)
+		}
+		if rules.requireContacts {
+			contact, err := db.GetContact(c.Request().Context(), identifier, newMessage.Identifier_to)
+			if err != nil {
+				return err
+			} else if contact == nil || contact.Status != contactAccepted {
+				return failStatus(c, newAPIError(codeForbidden,
+					"You can only send to contacts who have accepted you."))
+			}
+		}
+		err = checkMessageSignature(c.Request().Context(), db, channelNames[tableName],
+			newMessage, rules.requireSignature)
 		if err != nil {
 			return err
 		}
@@ -86,8 +710,14 @@ func handleNewMessage(db DataSource, tableName string, overwrite bool) func(echo
 			return err
 		}
 
-		err = db.AddMessage(tableName, newMessage.Identifier_from, newMessage.Identifier_to,
-			string(toAdd), overwrite && isPending)
+		var expiresAt *time.Time
+		if ttl > 0 {
+			expiry := time.Now().UTC().Add(ttl).Truncate(time.Second)
+			expiresAt = &expiry
+		}
+
+		err = db.AddMessage(c.Request().Context(), tableName, newMessage.Identifier_from, newMessage.Identifier_to,
+			string(toAdd), overwrite, expiresAt)
 		if err != nil {
 			return err
 		}
@@ -96,27 +726,84 @@ func handleNewMessage(db DataSource, tableName string, overwrite bool) func(echo
 	}
 }
 
-// handles a request to get unread messages for a given user
-func handleGetMessage(db DataSource, tableName string) func(echo.Context) error {
+// checks the signature on a message from the authenticated
+// newMessage.Identifier_from, if it has one or required is set. Returns an
+// invalid_credentials APIError if it is missing, doesn't match the sender's
+// current key, is too old, or was already used.
+func checkMessageSignature(ctx context.Context, db DataSource, channel string,
+	newMessage *NewMessageJSON, required bool) error {
+	if newMessage.Signature == "" {
+		if required {
+			return newAPIError(codeInvalidCredentials, "Messages must be signed.")
+		}
+		return nil
+	}
+
+	signedAt := time.Unix(newMessage.Timestamp, 0)
+	if skew := time.Since(signedAt); skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		return newAPIError(codeInvalidCredentials,
+			"Message timestamp is too far from the server's clock.")
+	}
+
+	stored, err := db.GetPublicKey(ctx, newMessage.Identifier_from)
+	if err != nil {
+		return err
+	} else if stored == nil {
+		return newAPIError(codeInvalidCredentials, "Register a public key to sign messages.")
+	}
+	key, err := parsePublicKey(stored.PEM)
+	if err != nil {
+		return err
+	}
+	message, err := signedMessage(channel, newMessage.Identifier_to, newMessage.Timestamp,
+		newMessage.Data)
+	if err != nil {
+		return err
+	}
+	if verifySignature(key, message, newMessage.Signature) != nil {
+		return newAPIError(codeInvalidCredentials, "Message signature doesn't match.")
+	}
+
+	// keyed on who signed what rather than the signature, which could be
+	// encoded more than one way
+	nonce := sha256.Sum256(append([]byte(newMessage.Identifier_from+"\n"), message...))
+	fresh, err := db.UseMessageNonce(ctx, hex.EncodeToString(nonce[:]),
+		signedAt.Add(signatureMaxSkew))
+	if err != nil {
+		return err
+	} else if !fresh {
+		return newAPIError(codeInvalidCredentials, "Message has already been sent.")
+	}
+	return nil
+}
+
+// handles a request to get unread messages for a given user.
+//
+// The returned messages are deleted straight away; this is kept for older app
+// builds, newer ones should use handleFetchMessages and handleAckMessages.
+func handleGetMessage(db DataSource, sm *SessionManager,
+	tableName string) func(echo.Context) error {
 	return func(c echo.Context) error {
 		user := new(User)
 		if err := c.Bind(user); err != nil {
 			return err
 		}
 
-		valid, err := db.isValidPassword(user.Identifier, user.Password)
+		identifier, err := sm.authenticate(c, user.Identifier, user.Password)
 		if err != nil {
 			return err
-		} else if !valid {
-			return failStatus(c, "Password doesn't match expected.")
+		} else if identifier == "" {
+			return failStatus(c, errBadPassword)
 		}
 
-		messages, err := db.GetMessages(tableName, user.Identifier)
+		messages, err := db.GetMessages(c.Request().Context(), tableName, identifier)
 		if err != nil {
 			return err
 		}
 
-		err = db.DeleteMessages(tableName, user.Identifier)
+		// only delete what we are returning, anything that arrived in the
+		// meantime stays pending
+		_, err = db.AckMessages(c.Request().Context(), tableName, identifier, messageIDs(messages))
 		if err != nil {
 			return err
 		}
@@ -125,10 +812,72 @@ func handleGetMessage(db DataSource, tableName string) func(echo.Context) error
 	}
 }
 
+// handles a request to get unread messages for a given user, without
+// deleting them. The client should ack them once they are stored.
+func handleFetchMessages(db DataSource, sm *SessionManager,
+	tableName string) func(echo.Context) error {
+	return func(c echo.Context) error {
+		user := new(User)
+		if err := c.Bind(user); err != nil {
+			return err
+		}
+
+		identifier, err := sm.authenticate(c, user.Identifier, user.Password)
+		if err != nil {
+			return err
+		} else if identifier == "" {
+			return failStatus(c, errBadPassword)
+		}
+
+		messages, err := db.GetMessages(c.Request().Context(), tableName, identifier)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, messages)
+	}
+}
+
+// handles a request to delete messages the user has received
+func handleAckMessages(db DataSource, sm *SessionManager,
+	tableName string) func(echo.Context) error {
+	return func(c echo.Context) error {
+		ack := new(AckMessagesJSON)
+		if err := c.Bind(ack); err != nil {
+			return err
+		}
+
+		identifier, err := sm.authenticate(c, ack.Identifier, ack.Password)
+		if err != nil {
+			return err
+		} else if identifier == "" {
+			return failStatus(c, errBadPassword)
+		}
+
+		deleted, err := db.AckMessages(c.Request().Context(), tableName, identifier, ack.IDs)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK,
+			map[string]interface{}{"success": true, "deleted": deleted})
+	}
+}
+
+// returns the IDs of the given messages
+func messageIDs(messages []Message) []int64 {
+	ids := make([]int64, len(messages))
+	for i, message := range messages {
+		ids[i] = message.ID
+	}
+	return ids
+}
+
 // data used in add_friend.html
 type AddFriendTemplate struct {
 	Identifier string
 	PubKey     string
+	Invite     string // optional, passed on to the app
 }
 
 func handleAddFriend(c echo.Context) error {
@@ -139,31 +888,33 @@ func handleAddFriend(c echo.Context) error {
 		return c.Render(http.StatusOK, "add_friend.html", AddFriendTemplate{
 			Identifier: identifier,
 			PubKey:     pubKey,
+			Invite:     c.QueryParam("invite"),
 		})
 	}
 	return c.String(http.StatusBadRequest, "That link doesn't look right.")
 }
 
-// returns true if both id and key are valid
+// returns true if both id and key are valid. Unlike registering a key, any
+// RSA key is accepted, since links already handed out must keep working.
 func isValidIDAndKey(id string, key string) bool {
 	if len(id) == 0 || len(key) == 0 {
 		return false
 	}
-	if len(key) < 62 {
-		return false
-	}
-	return strings.HasPrefix(key, "-----BEGIN RSA PUBLIC KEY-----") &&
-		strings.HasSuffix(key, "-----END RSA PUBLIC KEY-----")
-}
-
-// returns true if given password matches the password linked with identifier in DB
-func verifyIdentity(db DataSource, identifier string, password string) bool {
-	isValid, err := db.isValidPassword(identifier, password)
-	println(err)
-	return isValid
+	_, err := parsePublicKey(key)
+	return err == nil
 }
 
-func failStatus(c echo.Context, reason string) error {
-	return c.JSON(http.StatusBadRequest,
-		map[string]interface{}{"success": false, "reason": reason})
+// responds with the error envelope for apiErr
+func failStatus(c echo.Context, apiErr *APIError) error {
+	if apiErr.retryAfter > 0 {
+		// whole seconds, rounded up so the client doesn't retry too early
+		seconds := int64((apiErr.retryAfter + time.Second - 1) / time.Second)
+		c.Response().Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+	body := map[string]interface{}{
+		"success": false, "reason": apiErr.Reason, "code": apiErr.Code}
+	if len(apiErr.Fields) > 0 {
+		body["fields"] = apiErr.Fields
+	}
+	return c.JSON(apiErr.status(), body)
 }
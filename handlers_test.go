@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // mocked object that implements DataSource
@@ -21,7 +32,7 @@ func TestCheckUserExists(t *testing.T) {
 	identifier := "existing"
 	body := "{\"identifier\":\"" + identifier + "\"}"
 	fakeDB := new(FakeDB)
-	fakeDB.On("DoesUserExist", identifier).Return(true, nil)
+	fakeDB.On("DoesUserExist", mock.Anything, identifier).Return(true, nil)
 
 	// set up the fake request, and a recorder
 	e := echo.New()
@@ -31,7 +42,7 @@ func TestCheckUserExists(t *testing.T) {
 	c := e.NewContext(req, rec)
 
 	// perform the assertions, verify assumptions
-	if assert.NoError(t, handleCheckUser(fakeDB)(c)) {
+	if assert.NoError(t, handleCheckUser(fakeDB, newTestSessionManager(fakeDB), false)(c)) {
 		fakeDB.AssertExpectations(t)
 
 		assert.Equal(t, http.StatusOK, rec.Code)
@@ -43,7 +54,7 @@ func TestCheckUserDoesntExists(t *testing.T) {
 	identifier := "not-existing"
 	body := "{\"identifier\":\"" + identifier + "\"}"
 	fakeDB := new(FakeDB)
-	fakeDB.On("DoesUserExist", identifier).Return(false, nil)
+	fakeDB.On("DoesUserExist", mock.Anything, identifier).Return(false, nil)
 
 	e := echo.New()
 	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
@@ -51,7 +62,7 @@ func TestCheckUserDoesntExists(t *testing.T) {
 	rec := httptest.NewRecorder()
 	c := e.NewContext(req, rec)
 
-	if assert.NoError(t, handleCheckUser(fakeDB)(c)) {
+	if assert.NoError(t, handleCheckUser(fakeDB, newTestSessionManager(fakeDB), false)(c)) {
 		fakeDB.AssertExpectations(t)
 
 		assert.Equal(t, http.StatusOK, rec.Code)
@@ -59,23 +70,75 @@ func TestCheckUserDoesntExists(t *testing.T) {
 	}
 }
 
+func TestCheckUserRequiresProof(t *testing.T) {
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	invite, _ := sm.IssueInvite("user")
+	fakeDB.On("DoesUserExist", mock.Anything, "user").Return(true, nil)
+
+	check := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/user", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, handleCheckUser(fakeDB, sm, true)(echo.New().NewContext(req, rec)))
+		return rec
+	}
+
+	rec := check("{\"identifier\":\"user\"}")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	fakeDB.AssertNotCalled(t, "DoesUserExist", mock.Anything, mock.Anything)
+
+	// an invite for someone else doesn't help
+	rec = check("{\"identifier\":\"other\", \"invite\":\"" + invite + "\"}")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = check("{\"identifier\":\"user\", \"invite\":\"" + invite + "\"}")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "\"exists\":true")
+}
+
+func TestCheckUserSessionOnlyProvesContacts(t *testing.T) {
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	token := issueTestToken(t, fakeDB, sm, "user")
+	friend := newContact("user", "friend")
+	fakeDB.On("GetContact", mock.Anything, "user", "friend").Return(&friend, nil)
+	fakeDB.On("GetContact", mock.Anything, "user", "stranger").Return((*Contact)(nil), nil)
+	fakeDB.On("DoesUserExist", mock.Anything, mock.Anything).Return(true, nil)
+
+	check := func(identifier string) *httptest.ResponseRecorder {
+		body := "{\"identifier\":\"" + identifier + "\"}"
+		req := httptest.NewRequest(http.MethodPost, "/user", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, handleCheckUser(fakeDB, sm, true)(echo.New().NewContext(req, rec)))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, check("user").Code)
+	assert.Equal(t, http.StatusOK, check("friend").Code)
+	assert.Equal(t, http.StatusBadRequest, check("stranger").Code)
+	fakeDB.AssertNotCalled(t, "DoesUserExist", mock.Anything, "stranger")
+}
+
 func TestAddUser(t *testing.T) {
 	identifier := "user"
 	password := "battery horse staple"
 	body := "{\"identifier\":\"" + identifier + "\", \"password\": \""+ password +"\"}"
 
 	fakeDB := new(FakeDB)
-	fakeDB.On("DoesUserExist", identifier).Return(false, nil)
+	fakeDB.On("DoesUserExist", mock.Anything, identifier).Return(false, nil)
 	// NOTE: cannot easily compute the hash digest of password since bcrypt
 	// uses salts, therefore only verifying type
-	fakeDB.On("InsertUser", identifier, mock.AnythingOfType("[]uint8")).Return(nil)
+	fakeDB.On("InsertUser", mock.Anything, identifier, mock.AnythingOfType("[]uint8")).Return(nil)
 
 	req := httptest.NewRequest(http.MethodPost, "/user/new", strings.NewReader(body))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	rec := httptest.NewRecorder()
 	c := echo.New().NewContext(req, rec)
 
-	if assert.NoError(t, handleAddUser(fakeDB)(c)) {
+	if assert.NoError(t, handleAddUser(fakeDB, newTestSessionManager(fakeDB).hasher, false)(c)) {
 		fakeDB.AssertExpectations(t)
 
 		assert.Equal(t, http.StatusOK, rec.Code)
@@ -89,59 +152,808 @@ func TestDoesNotAddExistingUser(t *testing.T) {
 	body := "{\"identifier\":\"" + identifier + "\", \"password\": \""+ password +"\"}"
 
 	fakeDB := new(FakeDB)
-	fakeDB.On("DoesUserExist", identifier).Return(true, nil)
+	fakeDB.On("DoesUserExist", mock.Anything, identifier).Return(true, nil)
 
 	req := httptest.NewRequest(http.MethodPost, "/user/new", strings.NewReader(body))
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	rec := httptest.NewRecorder()
 	c := echo.New().NewContext(req, rec)
 
-	if assert.NoError(t, handleAddUser(fakeDB)(c)) {
+	if assert.NoError(t, handleAddUser(fakeDB, newTestSessionManager(fakeDB).hasher, false)(c)) {
+		fakeDB.AssertExpectations(t)
+		fakeDB.AssertNotCalled(t, "InsertUser", mock.Anything, identifier, mock.AnythingOfType("[]uint8"))
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"success\":false")
+	}
+}
+
+func TestAddUserInvalid(t *testing.T) {
+	body := "{\"identifier\":\"a b\", \"password\": \"12345678\"}"
+	fakeDB := new(FakeDB)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/new", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleAddUser(fakeDB, newTestSessionManager(fakeDB).hasher, false)(c)) {
+		fakeDB.AssertNotCalled(t, "InsertUser", mock.Anything, mock.Anything, mock.Anything)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"code\":\"validation\"")
+		assert.Contains(t, rec.Body.String(), "\"identifier\":\"Identifier can only contain")
+		assert.Contains(t, rec.Body.String(), "\"password\":\"Password is too easy")
+	}
+}
+
+func TestGetMessageDeletesOnlyReturned(t *testing.T) {
+	identifier := "user"
+	password := "battery horse staple"
+	body := "{\"identifier\":\"" + identifier + "\", \"password\": \"" + password + "\"}"
+	messages := []Message{
+		{ID: 3, Identifier_from: "friend", Data: "123"},
+		{ID: 7, Identifier_from: "friend2", Data: "1234"},
+	}
+
+	fakeDB := new(FakeDB)
+	fakeDB.On("GetPasswordDigest", mock.Anything, identifier).Return(testDigest, nil)
+	fakeDB.On("GetMessages", mock.Anything, messageTableName, identifier).Return(messages, nil)
+	fakeDB.On("AckMessages", mock.Anything, messageTableName, identifier, []int64{3, 7}).Return(int64(2), nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/message", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleGetMessage(fakeDB, newTestSessionManager(fakeDB), messageTableName)(c)) {
+		fakeDB.AssertExpectations(t)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"id\":7")
+	}
+}
+
+func TestFetchMessagesDoesNotDelete(t *testing.T) {
+	identifier := "user"
+	password := "battery horse staple"
+	body := "{\"identifier\":\"" + identifier + "\", \"password\": \"" + password + "\"}"
+	messages := []Message{{ID: 3, Identifier_from: "friend", Data: "123"}}
+
+	fakeDB := new(FakeDB)
+	fakeDB.On("GetPasswordDigest", mock.Anything, identifier).Return(testDigest, nil)
+	fakeDB.On("GetMessages", mock.Anything, nudgeTableName, identifier).Return(messages, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/nudge/fetch", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleFetchMessages(fakeDB, newTestSessionManager(fakeDB), nudgeTableName)(c)) {
 		fakeDB.AssertExpectations(t)
-		fakeDB.AssertNotCalled(t, "InsertUser", identifier, mock.AnythingOfType("[]uint8"))
+		fakeDB.AssertNotCalled(t, "AckMessages", mock.Anything, nudgeTableName, identifier, mock.Anything)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"id\":3")
+	}
+}
+
+func TestAckMessages(t *testing.T) {
+	identifier := "user"
+	password := "battery horse staple"
+	body := "{\"identifier\":\"" + identifier + "\", \"password\": \"" + password +
+		"\", \"ids\": [3, 4]}"
+
+	fakeDB := new(FakeDB)
+	fakeDB.On("GetPasswordDigest", mock.Anything, identifier).Return(testDigest, nil)
+	fakeDB.On("AckMessages", mock.Anything, messageTableName, identifier, []int64{3, 4}).Return(int64(1), nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/message/ack", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleAckMessages(fakeDB, newTestSessionManager(fakeDB), messageTableName)(c)) {
+		fakeDB.AssertExpectations(t)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"deleted\":1")
+	}
+}
+
+func TestAckMessagesWrongPassword(t *testing.T) {
+	identifier := "user"
+	password := "wrong"
+	body := "{\"identifier\":\"" + identifier + "\", \"password\": \"" + password +
+		"\", \"ids\": [3]}"
+
+	fakeDB := new(FakeDB)
+	fakeDB.On("GetPasswordDigest", mock.Anything, identifier).Return(testDigest, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/message/ack", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleAckMessages(fakeDB, newTestSessionManager(fakeDB), messageTableName)(c)) {
+		fakeDB.AssertExpectations(t)
+		fakeDB.AssertNotCalled(t, "AckMessages", mock.Anything, messageTableName, identifier, mock.Anything)
 
 		assert.Equal(t, http.StatusBadRequest, rec.Code)
 		assert.Contains(t, rec.Body.String(), "\"success\":false")
 	}
 }
 
-func (db *FakeDB) DoesUserExist(identifier string) (bool, error) {
-	args := db.Called(identifier)
+func TestLoginIssuesToken(t *testing.T) {
+	identifier := "user"
+	password := "battery horse staple"
+	body := "{\"identifier\":\"" + identifier + "\", \"password\": \"" + password + "\"}"
+
+	fakeDB := new(FakeDB)
+	fakeDB.On("GetPasswordDigest", mock.Anything, identifier).Return(testDigest, nil)
+	fakeDB.On("InsertSession", mock.Anything, mock.MatchedBy(func(s Session) bool {
+		return s.Identifier == identifier && s.ExpiresAt.After(time.Now())
+	})).Return(nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/login", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleLogin(newTestSessionManager(fakeDB))(c)) {
+		fakeDB.AssertExpectations(t)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"token\":")
+	}
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	identifier := "user"
+	password := "wrong"
+	body := "{\"identifier\":\"" + identifier + "\", \"password\": \"" + password + "\"}"
+
+	fakeDB := new(FakeDB)
+	fakeDB.On("GetPasswordDigest", mock.Anything, identifier).Return(testDigest, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/login", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleLogin(newTestSessionManager(fakeDB))(c)) {
+		fakeDB.AssertNotCalled(t, "InsertSession", mock.Anything, mock.Anything)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"success\":false")
+		assert.Contains(t, rec.Body.String(), "\"code\":\"invalid_credentials\"")
+	}
+}
+
+func TestFetchMessagesWithToken(t *testing.T) {
+	identifier := "user"
+	messages := []Message{{ID: 3, Identifier_from: "friend", Data: "123"}}
+
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	token := issueTestToken(t, fakeDB, sm, identifier)
+	fakeDB.On("GetMessages", mock.Anything, messageTableName, identifier).Return(messages, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/message/fetch", strings.NewReader("{}"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleFetchMessages(fakeDB, sm, messageTableName)(c)) {
+		fakeDB.AssertExpectations(t)
+		fakeDB.AssertNotCalled(t, "GetPasswordDigest", mock.Anything, mock.Anything)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"id\":3")
+	}
+}
+
+func TestFetchMessagesForgedToken(t *testing.T) {
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	token := issueTestToken(t, fakeDB, sm, "user")
+	forged := token[:len(token)-2] + "xx"
+
+	req := httptest.NewRequest(http.MethodPost, "/user/message/fetch", strings.NewReader("{}"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+forged)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleFetchMessages(fakeDB, sm, messageTableName)(c)) {
+		fakeDB.AssertNotCalled(t, "GetMessages", mock.Anything, messageTableName, mock.Anything)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	token := issueTestToken(t, fakeDB, sm, "user")
+	fakeDB.On("DeleteSession", mock.Anything, strings.Split(token, ".")[0]).Return(nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/logout", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleLogout(sm)(c)) {
+		fakeDB.AssertExpectations(t)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	identifier := "user"
+	body := "{\"identifier\":\"" + identifier +
+		"\", \"password\": \"battery horse staple\", \"new_password\": \"correct horse\"}"
+
+	fakeDB := new(FakeDB)
+	fakeDB.On("GetPasswordDigest", mock.Anything, identifier).Return(testDigest, nil)
+	fakeDB.On("UpdatePassword", mock.Anything, identifier, mock.MatchedBy(func(digest []byte) bool {
+		return bcrypt.CompareHashAndPassword(digest, []byte("correct horse")) == nil
+	})).Return(nil)
+	fakeDB.On("DeleteSessions", mock.Anything, identifier).Return(int64(2), nil)
+	fakeDB.On("InsertSession", mock.Anything, mock.AnythingOfType("Session")).Return(nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/password", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleChangePassword(fakeDB, newTestSessionManager(fakeDB))(c)) {
+		fakeDB.AssertExpectations(t)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"token\":")
+	}
+}
+
+func TestChangePasswordWrongPassword(t *testing.T) {
+	body := "{\"identifier\":\"user\", \"password\": \"wrong\", \"new_password\": \"correct horse\"}"
+
+	fakeDB := new(FakeDB)
+	fakeDB.On("GetPasswordDigest", mock.Anything, "user").Return(testDigest, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/password", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleChangePassword(fakeDB, newTestSessionManager(fakeDB))(c)) {
+		fakeDB.AssertNotCalled(t, "UpdatePassword", mock.Anything, mock.Anything, mock.Anything)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestDeleteUserWithToken(t *testing.T) {
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	token := issueTestToken(t, fakeDB, sm, "user")
+	receipt := &DeletionReceipt{Identifier: "user", Messages: 2, Sessions: 1}
+	fakeDB.On("DeleteUser", mock.Anything, "user").Return(receipt, nil)
+
+	req := httptest.NewRequest(http.MethodDelete, "/user", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleDeleteUser(fakeDB, sm)(c)) {
+		fakeDB.AssertExpectations(t)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"messages\":2")
+	}
+}
+
+func TestDeleteUserWrongPassword(t *testing.T) {
+	body := "{\"identifier\":\"user\", \"password\": \"wrong\"}"
+
+	fakeDB := new(FakeDB)
+	fakeDB.On("GetPasswordDigest", mock.Anything, "user").Return(testDigest, nil)
+
+	req := httptest.NewRequest(http.MethodDelete, "/user", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleDeleteUser(fakeDB, newTestSessionManager(fakeDB))(c)) {
+		fakeDB.AssertNotCalled(t, "DeleteUser", mock.Anything, mock.Anything)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestRegisterKeyRotates(t *testing.T) {
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	token := issueTestToken(t, fakeDB, sm, "user")
+	old := &PublicKey{Identifier: "user", Fingerprint: "old"}
+	fakeDB.On("GetPublicKey", mock.Anything, "user").Return(old, nil)
+	fakeDB.On("AddPublicKey", mock.Anything, mock.MatchedBy(func(key PublicKey) bool {
+		return key.Identifier == "user" && key.Fingerprint == testKeyFingerprint
+	})).Return(nil)
+
+	body := "{\"key\":" + strconv.Quote(testKeyPEM) + "}"
+	req := httptest.NewRequest(http.MethodPost, "/user/key", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleRegisterKey(fakeDB, sm)(c)) {
+		fakeDB.AssertExpectations(t)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), testKeyFingerprint)
+	}
+}
+
+func TestRegisterKeyInvalid(t *testing.T) {
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	token := issueTestToken(t, fakeDB, sm, "user")
+
+	body := "{\"key\":\"-----BEGIN RSA PUBLIC KEY-----\\nnot a key\\n-----END RSA PUBLIC KEY-----\"}"
+	req := httptest.NewRequest(http.MethodPost, "/user/key", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	err := handleRegisterKey(fakeDB, sm)(c)
+	fakeDB.AssertNotCalled(t, "AddPublicKey", mock.Anything, mock.Anything)
+	if assert.Error(t, err) {
+		apiErr := toAPIError(err)
+		assert.Equal(t, codeValidation, apiErr.Code)
+		assert.Contains(t, apiErr.Fields, "key")
+	}
+}
+
+func TestGetKeyNotFound(t *testing.T) {
+	fakeDB := new(FakeDB)
+	fakeDB.On("GetPublicKey", mock.Anything, "user").Return((*PublicKey)(nil), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/user/key?identifier=user", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleGetKey(fakeDB, newTestSessionManager(fakeDB), false)(c)) {
+		fakeDB.AssertExpectations(t)
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"code\":\"not_found\"")
+	}
+}
+
+func TestNewMessageRequiresContacts(t *testing.T) {
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	token := issueTestToken(t, fakeDB, sm, "user")
+	pending := newContact("user", "friend")
+	fakeDB.On("GetContact", mock.Anything, "user", "friend").Return(&pending, nil)
+	fakeDB.On("GetContact", mock.Anything, "user", "stranger").Return((*Contact)(nil), nil)
+	fakeDB.On("IsBlocked", mock.Anything, mock.Anything, "user").Return(false, nil)
+
+	for _, to := range []string{"friend", "stranger"} {
+		body := "{\"identifier_to\":\"" + to + "\", \"data\":\"hi\"}"
+		req := httptest.NewRequest(http.MethodPost, "/user/nudge/new", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+
+		if assert.NoError(t, handleNewMessage(fakeDB, sm, nudgeTableName, false, 0,
+			messageRules{requireContacts: true})(c)) {
+			assert.Equal(t, http.StatusForbidden, rec.Code)
+			assert.Contains(t, rec.Body.String(), "\"code\":\"forbidden\"")
+		}
+	}
+	fakeDB.AssertExpectations(t)
+	fakeDB.AssertNotCalled(t, "AddMessage", mock.Anything, mock.Anything, mock.Anything,
+		mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestContactRequestAcceptsWhenAsked(t *testing.T) {
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	token := issueTestToken(t, fakeDB, sm, "user")
+	asked := newContact("friend", "user")
+	fakeDB.On("DoesUserExist", mock.Anything, "friend").Return(true, nil)
+	fakeDB.On("IsBlocked", mock.Anything, "friend", "user").Return(false, nil)
+	fakeDB.On("GetContact", mock.Anything, "user", "friend").Return(&asked, nil)
+	fakeDB.On("SaveContact", mock.Anything, mock.MatchedBy(func(contact Contact) bool {
+		return contact.Status == contactAccepted && contact.RequestedBy == "friend"
+	})).Return(nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/contacts/request",
+		strings.NewReader("{\"contact\":\"friend\"}"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleContactRequest(fakeDB, sm)(c)) {
+		fakeDB.AssertExpectations(t)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"status\":\"accepted\"")
+	}
+}
+
+func TestContactAcceptOwnRequest(t *testing.T) {
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	token := issueTestToken(t, fakeDB, sm, "user")
+	own := newContact("user", "friend")
+	fakeDB.On("GetContact", mock.Anything, "user", "friend").Return(&own, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/contacts/accept",
+		strings.NewReader("{\"contact\":\"friend\"}"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleContactAccept(fakeDB, sm)(c)) {
+		fakeDB.AssertNotCalled(t, "SaveContact", mock.Anything, mock.Anything)
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestNewMessageBlocked(t *testing.T) {
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	token := issueTestToken(t, fakeDB, sm, "user")
+	fakeDB.On("IsBlocked", mock.Anything, "friend", "user").Return(true, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/message/new",
+		strings.NewReader("{\"identifier_to\":\"friend\", \"data\":\"hi\"}"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	// blocks apply whether or not contacts are required
+	if assert.NoError(t, handleNewMessage(fakeDB, sm, messageTableName, true, 0, messageRules{})(c)) {
+		fakeDB.AssertExpectations(t)
+		fakeDB.AssertNotCalled(t, "AddMessage", mock.Anything, mock.Anything, mock.Anything,
+			mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	}
+}
+
+func TestReport(t *testing.T) {
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	token := issueTestToken(t, fakeDB, sm, "user")
+	fakeDB.On("GetMessages", mock.Anything, nudgeTableName, "user").Return([]Message{
+		{ID: 11, Identifier_from: "friend", Channel: "nudge", Data: "hi"},
+		{ID: 12, Identifier_from: "troll", Channel: "nudge", Data: map[string]interface{}{"text": "boo"}},
+		{ID: 13, Identifier_from: "troll", Channel: "nudge", Data: "{oops", Malformed: true},
+	}, nil)
+	fakeDB.On("AddReport", mock.Anything, mock.MatchedBy(func(report Report) bool {
+		return report.Reporter == "user" && report.Reported == "troll" &&
+			report.Channel == "nudge" && report.MessageID == 12 && report.Data == "{\"text\":\"boo\"}"
+	})).Return(int64(3), nil)
+	fakeDB.On("AddReport", mock.Anything, mock.MatchedBy(func(report Report) bool {
+		return report.MessageID == 13 && report.Data == "{oops"
+	})).Return(int64(4), nil)
+
+	report := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/user/report", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		assert.NoError(t, handleReport(fakeDB, sm)(echo.New().NewContext(req, rec)))
+		return rec
+	}
+
+	rec := report("{\"reported\":\"troll\", \"channel\":\"nudge\", \"message_id\":12}")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "\"report_id\":3")
+
+	// malformed data is kept as it was stored
+	rec = report("{\"reported\":\"troll\", \"channel\":\"nudge\", \"message_id\":13}")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "\"report_id\":4")
+
+	rec = report("{\"reported\":\"troll\", \"channel\":\"email\"}")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "\"channel\":")
+	assert.Contains(t, rec.Body.String(), "\"message_id\":")
+
+	// only messages the user was sent, by who they say sent them
+	for _, body := range []string{
+		"{\"reported\":\"troll\", \"channel\":\"nudge\", \"message_id\":11}",
+		"{\"reported\":\"troll\", \"channel\":\"nudge\", \"message_id\":99}",
+		"{\"reported\":\"friend\", \"channel\":\"nudge\", \"message_id\":12}",
+	} {
+		rec = report(body)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"not_found\"")
+	}
+	fakeDB.AssertNumberOfCalls(t, "AddReport", 2)
+}
+
+func TestNewMessageSigned(t *testing.T) {
+	fakeDB := new(FakeDB)
+	sm := newTestSessionManager(fakeDB)
+	token := issueTestToken(t, fakeDB, sm, "user")
+	fakeDB.On("GetPublicKey", mock.Anything, "user").Return(
+		&PublicKey{Identifier: "user", PEM: testKeyPEM}, nil)
+	fakeDB.On("UseMessageNonce", mock.Anything, mock.AnythingOfType("string"),
+		mock.AnythingOfType("time.Time")).Return(true, nil).Once()
+	fakeDB.On("UseMessageNonce", mock.Anything, mock.AnythingOfType("string"),
+		mock.AnythingOfType("time.Time")).Return(false, nil)
+	fakeDB.On("IsBlocked", mock.Anything, mock.Anything, "user").Return(false, nil)
+	fakeDB.On("AddMessage", mock.Anything, messageTableName, "user", "friend",
+		`{"score":7}`, true, mock.MatchedBy(func(expiresAt *time.Time) bool {
+			return expiresAt != nil && expiresAt.After(time.Now().Add(time.Hour-time.Minute))
+		})).Return(nil).Once()
+
+	send := func(body string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodPost, "/user/message/new", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		err := handleNewMessage(fakeDB, sm, messageTableName, true, time.Hour,
+			messageRules{requireSignature: true})(echo.New().NewContext(req, rec))
+		return rec, err
+	}
+
+	timestamp := time.Now().Unix()
+	signature := signTestMessage(t, "message", "friend", timestamp, `{"score": 7}`)
+	body := fmt.Sprintf(`{"identifier_to":"friend", "data":{"score": 7}, `+
+		`"timestamp":%d, "signature":"%s"}`, timestamp, signature)
+	rec, err := send(body)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	// replayed
+	_, err = send(body)
+	assert.Equal(t, codeInvalidCredentials, toAPIError(err).Code)
+
+	// signed for someone else
+	_, err = send(strings.Replace(body, `"friend"`, `"other"`, 1))
+	assert.Equal(t, codeInvalidCredentials, toAPIError(err).Code)
+
+	// required
+	_, err = send(`{"identifier_to":"friend", "data":{"score": 7}}`)
+	assert.Equal(t, codeInvalidCredentials, toAPIError(err).Code)
+
+	fakeDB.AssertExpectations(t)
+}
+
+// signs a message the way the app would, with testKey
+func signTestMessage(t *testing.T, channel string, identifierTo string,
+	timestamp int64, data string) string {
+	message, err := signedMessage(channel, identifierTo, timestamp, json.RawMessage(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(message)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, testKey, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+// digest of "battery horse staple", made the way newTestSessionManager's
+// hasher would so it isn't rehashed
+var testDigest, _ = bcrypt.GenerateFromPassword([]byte("battery horse staple"), bcrypt.MinCost)
+
+// lockouts are off, so the fake doesn't need to expect lockout calls
+func newTestSessionManager(db DataSource) *SessionManager {
+	return newSessionManager(db, []byte("test secret"), time.Hour, LockoutConfig{},
+		newPasswordHasher(PasswordConfig{BcryptCost: bcrypt.MinCost}))
+}
+
+// issues a token for identifier, with fakeDB set up to recognise it
+func issueTestToken(t *testing.T, fakeDB *FakeDB, sm *SessionManager, identifier string) string {
+	var session Session
+	fakeDB.On("InsertSession", mock.Anything, mock.AnythingOfType("Session")).
+		Run(func(args mock.Arguments) { session = args.Get(1).(Session) }).
+		Return(nil).Once()
+
+	token, _, err := sm.Issue(context.Background(), identifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakeDB.On("GetSession", mock.Anything, session.ID).Return(&session, nil)
+	return token
+}
+
+func (db *FakeDB) DoesUserExist(ctx context.Context, identifier string) (bool, error) {
+	args := db.Called(ctx, identifier)
 	// these behave as strongly typed getters
 	return args.Bool(0), args.Error(1)
 }
 
-func (mydb *FakeDB) InsertUser(identifier string, digest []byte) error {
-	args := mydb.Called(identifier, digest)
+func (mydb *FakeDB) InsertUser(ctx context.Context, identifier string, digest []byte) error {
+	args := mydb.Called(ctx, identifier, digest)
 	return args.Error(0)
 }
 
-func (mydb *FakeDB) IsMessagePending(
-	tableName string,
-	identifier_from string, identifier_to string) (bool, error) {
-	args := mydb.Called(tableName, identifier_from, identifier_to)
+func (mydb *FakeDB) DeleteUser(ctx context.Context, identifier string) (*DeletionReceipt, error) {
+	args := mydb.Called(ctx, identifier)
+	return args.Get(0).(*DeletionReceipt), args.Error(1)
+}
+
+func (mydb *FakeDB) GetPasswordDigest(ctx context.Context, identifier string) ([]byte, error) {
+	args := mydb.Called(ctx, identifier)
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+func (mydb *FakeDB) UpdatePassword(ctx context.Context, identifier string, digest []byte) error {
+	args := mydb.Called(ctx, identifier, digest)
+	return args.Error(0)
+}
+
+func (mydb *FakeDB) AddMessage(ctx context.Context,
+	tableName string, identifier_from string, identifier_to string,
+	data string, overwrite bool, expiresAt *time.Time) error {
+	args := mydb.Called(ctx, tableName, identifier_from, identifier_to, data, overwrite, expiresAt)
+	return args.Error(0)
+}
+
+func (mydb *FakeDB) GetMessages(ctx context.Context, tableName string, identifier string) ([]Message, error) {
+	args := mydb.Called(ctx, tableName, identifier)
+
+	// we'll panic if first arg is not the expected type
+	return args.Get(0).([]Message), args.Error(1)
+}
+
+func (mydb *FakeDB) CountMessages(ctx context.Context, tableName string) (int64, error) {
+	args := mydb.Called(ctx, tableName)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (mydb *FakeDB) AckMessages(ctx context.Context, tableName string, identifier string, ids []int64) (int64, error) {
+	args := mydb.Called(ctx, tableName, identifier, ids)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (mydb *FakeDB) InsertSession(ctx context.Context, session Session) error {
+	args := mydb.Called(ctx, session)
+	return args.Error(0)
+}
+
+func (mydb *FakeDB) GetSession(ctx context.Context, id string) (*Session, error) {
+	args := mydb.Called(ctx, id)
+	return args.Get(0).(*Session), args.Error(1)
+}
+
+func (mydb *FakeDB) DeleteSession(ctx context.Context, id string) error {
+	args := mydb.Called(ctx, id)
+	return args.Error(0)
+}
+
+func (mydb *FakeDB) DeleteSessions(ctx context.Context, identifier string) (int64, error) {
+	args := mydb.Called(ctx, identifier)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (mydb *FakeDB) GetLockout(ctx context.Context, key string) (*Lockout, error) {
+	args := mydb.Called(ctx, key)
+	return args.Get(0).(*Lockout), args.Error(1)
+}
+
+func (mydb *FakeDB) UpdateLockout(ctx context.Context, key string,
+	update func(lockout *Lockout)) error {
+	args := mydb.Called(ctx, key, update)
+	return args.Error(0)
+}
+
+func (mydb *FakeDB) InsertLockout(ctx context.Context, lockout Lockout) (bool, error) {
+	args := mydb.Called(ctx, lockout)
+	return args.Bool(0), args.Error(1)
+}
+
+func (mydb *FakeDB) ReleaseLockout(ctx context.Context, key string, failures int) (bool, error) {
+	args := mydb.Called(ctx, key, failures)
 	return args.Bool(0), args.Error(1)
 }
 
-func (mydb *FakeDB) AddMessage(tableName string, identifier_from string, identifier_to string,
-	data string, wasPending bool) error {
-	args := mydb.Called(tableName, identifier_from, identifier_to, data, wasPending)
+func (mydb *FakeDB) ClearLockout(ctx context.Context, key string) (bool, error) {
+	args := mydb.Called(ctx, key)
+	return args.Bool(0), args.Error(1)
+}
+
+func (mydb *FakeDB) ListLockouts(ctx context.Context) ([]Lockout, error) {
+	args := mydb.Called(ctx)
+	return args.Get(0).([]Lockout), args.Error(1)
+}
+
+func (mydb *FakeDB) AddPublicKey(ctx context.Context, key PublicKey) error {
+	args := mydb.Called(ctx, key)
 	return args.Error(0)
 }
 
-func (mydb *FakeDB) isValidPassword(identifier string, password string) (bool, error) {
-	args := mydb.Called(identifier, password)
+func (mydb *FakeDB) GetPublicKey(ctx context.Context, identifier string) (*PublicKey, error) {
+	args := mydb.Called(ctx, identifier)
+	return args.Get(0).(*PublicKey), args.Error(1)
+}
+
+func (mydb *FakeDB) ListPublicKeys(ctx context.Context, identifier string) ([]PublicKey, error) {
+	args := mydb.Called(ctx, identifier)
+	return args.Get(0).([]PublicKey), args.Error(1)
+}
+
+func (mydb *FakeDB) UseMessageNonce(ctx context.Context, nonce string, expiresAt time.Time) (bool, error) {
+	args := mydb.Called(ctx, nonce, expiresAt)
 	return args.Bool(0), args.Error(1)
 }
 
-func (mydb *FakeDB) GetMessages(tableName string, identifier string) ([]interface{}, error) {
-	args := mydb.Called(tableName, identifier)
+func (mydb *FakeDB) GetContact(ctx context.Context, identifier string, other string) (*Contact, error) {
+	args := mydb.Called(ctx, identifier, other)
+	return args.Get(0).(*Contact), args.Error(1)
+}
 
-	// we'll panic if first arg is not the expected type
-	return args.Get(0).([]interface{}), args.Error(1)
+func (mydb *FakeDB) SaveContact(ctx context.Context, contact Contact) error {
+	args := mydb.Called(ctx, contact)
+	return args.Error(0)
+}
+
+func (mydb *FakeDB) DeleteContact(ctx context.Context, identifier string, other string) (bool, error) {
+	args := mydb.Called(ctx, identifier, other)
+	return args.Bool(0), args.Error(1)
+}
+
+func (mydb *FakeDB) ListContacts(ctx context.Context, identifier string) ([]Contact, error) {
+	args := mydb.Called(ctx, identifier)
+	return args.Get(0).([]Contact), args.Error(1)
 }
 
-func (mydb *FakeDB) DeleteMessages(tableName string, identifier string) error {
-	args := mydb.Called(tableName, identifier)
+func (mydb *FakeDB) BlockUser(ctx context.Context, blocker string, blocked string) error {
+	args := mydb.Called(ctx, blocker, blocked)
 	return args.Error(0)
 }
+
+func (mydb *FakeDB) UnblockUser(ctx context.Context, blocker string, blocked string) (bool, error) {
+	args := mydb.Called(ctx, blocker, blocked)
+	return args.Bool(0), args.Error(1)
+}
+
+func (mydb *FakeDB) IsBlocked(ctx context.Context, blocker string, blocked string) (bool, error) {
+	args := mydb.Called(ctx, blocker, blocked)
+	return args.Bool(0), args.Error(1)
+}
+
+func (mydb *FakeDB) AddReport(ctx context.Context, report Report) (int64, error) {
+	args := mydb.Called(ctx, report)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (mydb *FakeDB) ListOpenReports(ctx context.Context) ([]Report, error) {
+	args := mydb.Called(ctx)
+	return args.Get(0).([]Report), args.Error(1)
+}
+
+func (mydb *FakeDB) ResolveReport(ctx context.Context, id int64) (bool, error) {
+	args := mydb.Called(ctx, id)
+	return args.Bool(0), args.Error(1)
+}
+
+func (mydb *FakeDB) DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error) {
+	args := mydb.Called(ctx, now)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (mydb *FakeDB) DeleteExpiredMessages(ctx context.Context, tableName string, now time.Time) (int64, error) {
+	args := mydb.Called(ctx, tableName, now)
+	return args.Get(0).(int64), args.Error(1)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// how long /readyz waits for the database to answer
+const readyzPingTimeout = 2 * time.Second
+
+// liveness: the process is up and serving requests
+func handleHealthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readiness: the main database answers, and the map data has been refreshed
+// recently. Responds 503 if either isn't the case.
+//
+// The map data counts as stale after two refresh intervals, so a refresh that
+// is in progress or a single failed one doesn't take us out of service.
+func handleReadyz(db *sql.DB, refresh time.Duration) func(echo.Context) error {
+	return func(c echo.Context) error {
+		ready := true
+
+		ctx, cancel := context.WithTimeout(c.Request().Context(), readyzPingTimeout)
+		defer cancel()
+		database := map[string]interface{}{"ok": true}
+		if err := db.PingContext(ctx); err != nil {
+			ready = false
+			database["ok"] = false
+			database["error"] = err.Error()
+		}
+
+		mapTemplate.mu.Lock()
+		lastRefresh := mapTemplate.lastRefresh
+		lastErr := mapTemplate.lastErr
+		lastErrorTime := mapTemplate.lastErrorTime
+		mapTemplate.mu.Unlock()
+
+		mapCache := map[string]interface{}{"ok": true}
+		if lastRefresh.IsZero() {
+			mapCache["last_refresh"] = nil
+		} else {
+			mapCache["last_refresh"] = lastRefresh.UTC()
+		}
+		if lastRefresh.IsZero() || time.Since(lastRefresh) > 2*refresh {
+			ready = false
+			mapCache["ok"] = false
+		}
+		if lastErr != nil {
+			mapCache["last_error"] = lastErr.Error()
+			mapCache["last_error_time"] = lastErrorTime.UTC()
+		}
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		return c.JSON(status, map[string]interface{}{
+			"ready": ready, "database": database, "map_cache": mapCache})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// sets the map cache state for the rest of the test
+func setMapCacheState(t *testing.T, lastRefresh time.Time, lastErr error) {
+	mapTemplate.mu.Lock()
+	mapTemplate.lastRefresh, mapTemplate.lastErr = lastRefresh, lastErr
+	mapTemplate.lastErrorTime = time.Now()
+	mapTemplate.mu.Unlock()
+	t.Cleanup(func() {
+		mapTemplate.mu.Lock()
+		mapTemplate.lastRefresh, mapTemplate.lastErr = time.Time{}, nil
+		mapTemplate.mu.Unlock()
+	})
+}
+
+func TestReadyz(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	setMapCacheState(t, time.Now(), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleReadyz(db.database, time.Minute)(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"ready\":true")
+	}
+}
+
+func TestReadyzStaleMapCache(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	setMapCacheState(t, time.Now().Add(-time.Hour), errors.New("scores table is missing"))
+
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleReadyz(db.database, time.Minute)(c)) {
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"ready\":false")
+		assert.Contains(t, rec.Body.String(), "scores table is missing")
+	}
+}
+
+func TestReadyzDatabaseDown(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	db.database.Close()
+	setMapCacheState(t, time.Now(), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	if assert.NoError(t, handleReadyz(db.database, time.Minute)(c)) {
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\"database\":{\"error\"")
+	}
+}
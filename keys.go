@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sizes of RSA key we accept for the registry, in bits
+const (
+	minRSAKeyBits = 2048
+	maxRSAKeyBits = 8192 // bigger ones are slow to use for no real gain
+)
+
+// how far a signed message's timestamp may be from our clock
+const signatureMaxSkew = 5 * time.Minute
+
+// a user's RSA public key, as registered
+type PublicKey struct {
+	Identifier  string     `json:"identifier"`
+	PEM         string     `json:"key"`
+	Fingerprint string     `json:"fingerprint"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ReplacedAt  *time.Time `json:"replaced_at,omitempty"` // nil for the current key
+}
+
+// parses a PEM encoded RSA public key, either PKCS #1 ("RSA PUBLIC KEY", which
+// the app makes) or PKIX ("PUBLIC KEY"). The bare base64 of either, without
+// the PEM armour, is accepted too.
+func parsePublicKey(encoded string) (*rsa.PublicKey, error) {
+	encoded = strings.TrimSpace(encoded)
+	if !strings.HasPrefix(encoded, "-----BEGIN ") {
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+		if err != nil {
+			return nil, errors.New("key is neither PEM nor base64 encoded")
+		}
+		if key, err := x509.ParsePKCS1PublicKey(der); err == nil {
+			return key, nil
+		}
+		return parsePKIXPublicKey(der)
+	}
+
+	block, rest := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, errors.New("key isn't PEM encoded")
+	} else if len(strings.TrimSpace(string(rest))) > 0 {
+		return nil, errors.New("key has data after the PEM block")
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		return parsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+}
+
+func parsePKIXPublicKey(der []byte) (*rsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("key isn't an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// parses encoded and checks it is fit for the registry, returning what to
+// store. Returns a validation APIError if it isn't.
+func newPublicKey(identifier string, encoded string) (*PublicKey, error) {
+	key, err := parsePublicKey(encoded)
+	if err != nil {
+		return nil, validationError(map[string]string{"key": "Key isn't a valid RSA public key."})
+	}
+	if bits := key.N.BitLen(); bits < minRSAKeyBits || bits > maxRSAKeyBits {
+		return nil, validationError(map[string]string{
+			"key": "Key must be between 2048 and 8192 bits."})
+	}
+
+	encoded = strings.TrimSpace(encoded)
+	if !strings.HasPrefix(encoded, "-----BEGIN ") {
+		// stored with the armour, so friends get it the usual way
+		encoded = strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{
+			Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(key)})))
+	}
+	return &PublicKey{
+		Identifier:  identifier,
+		PEM:         encoded,
+		Fingerprint: keyFingerprint(key),
+		CreatedAt:   time.Now().UTC().Truncate(time.Second),
+	}, nil
+}
+
+// the hex SHA-256 of the key's PKIX encoding, so it is the same whichever
+// way the key was sent
+func keyFingerprint(key *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		// only for key types other than RSA
+		panic(err)
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// the bytes a message signature covers, one field per line:
+//
+//	nudgeme-message
+//	<channel, "message" or "nudge">
+//	<identifier_to>
+//	<timestamp, Unix seconds>
+//	<data, as compact JSON>
+//
+// The sender is implied by the key.
+func signedMessage(channel string, identifierTo string, timestamp int64,
+	data json.RawMessage) ([]byte, error) {
+	var compact bytes.Buffer
+	if len(data) > 0 {
+		if err := json.Compact(&compact, data); err != nil {
+			return nil, err
+		}
+	} else {
+		compact.WriteString("null")
+	}
+	return []byte(fmt.Sprintf("nudgeme-message\n%s\n%s\n%d\n%s",
+		channel, identifierTo, timestamp, compact.String())), nil
+}
+
+// checks signature, base64 encoded, is key's RSASSA-PKCS1-v1_5 SHA-256
+// signature of message
+func verifySignature(key *rsa.PublicKey, message []byte, signature string) error {
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(message)
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], decoded)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a 2048 bit key, PKCS #1 encoded like the app does, and its fingerprint
+var testKey, testKeyPEM, testKeyFingerprint = newTestKey(2048)
+
+func newTestKey(bits int) (*rsa.PrivateKey, string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		panic(err)
+	}
+	encoded := pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+	return key, string(encoded), keyFingerprint(&key.PublicKey)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	key, err := parsePublicKey(testKeyPEM)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testKey.PublicKey, *key)
+	}
+
+	// the same key in PKIX form has the same fingerprint
+	der, _ := x509.MarshalPKIXPublicKey(&testKey.PublicKey)
+	pkix := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	key, err = parsePublicKey(string(pkix))
+	if assert.NoError(t, err) {
+		assert.Equal(t, testKeyFingerprint, keyFingerprint(key))
+	}
+
+	// and without the armour, in either form
+	bare := base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(&testKey.PublicKey))
+	for _, encoded := range []string{bare, base64.StdEncoding.EncodeToString(der)} {
+		key, err = parsePublicKey(encoded)
+		if assert.NoError(t, err) {
+			assert.Equal(t, testKeyFingerprint, keyFingerprint(key))
+		}
+	}
+
+	for _, encoded := range []string{
+		"",
+		"not PEM",
+		"bm90IGEga2V5", // base64, but not of a key
+		bare[:len(bare)/2],
+		"-----BEGIN RSA PUBLIC KEY-----\nbm90IGEga2V5\n-----END RSA PUBLIC KEY-----",
+		testKeyPEM + testKeyPEM,
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	} {
+		_, err := parsePublicKey(encoded)
+		assert.Error(t, err, encoded)
+	}
+}
+
+func TestNewPublicKey(t *testing.T) {
+	key, err := newPublicKey("user", testKeyPEM)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testKeyFingerprint, key.Fingerprint)
+		assert.Len(t, key.Fingerprint, 64)
+		assert.Nil(t, key.ReplacedAt)
+	}
+
+	_, small, _ := newTestKey(1024)
+	_, err = newPublicKey("user", small)
+	if assert.Error(t, err) {
+		assert.Equal(t, codeValidation, toAPIError(err).Code)
+	}
+}
+
+func TestIsValidIDAndKey(t *testing.T) {
+	assert.True(t, isValidIDAndKey("user", testKeyPEM))
+	assert.False(t, isValidIDAndKey("", testKeyPEM))
+	// looked fine to the old prefix and suffix check
+	assert.False(t, isValidIDAndKey("user",
+		"-----BEGIN RSA PUBLIC KEY-----\nnot a key at all\n-----END RSA PUBLIC KEY-----"))
+	assert.False(t, isValidIDAndKey("user", "-----BEGIN RSA PUBLIC KEY-----"))
+	assert.False(t, isValidIDAndKey("user", "not a key"))
+
+	// without the armour
+	bare := base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(&testKey.PublicKey))
+	assert.True(t, isValidIDAndKey("user", bare))
+}
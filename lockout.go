@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// failed password attempts recorded under a key, which is "id:<identifier>" or
+// "ip:<address>"
+type Lockout struct {
+	Key         string     `json:"key"`
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	LockedUntil *time.Time `json:"locked_until"` // nil until the threshold is reached
+}
+
+// returns true if the key is locked out at now
+func (l *Lockout) isLocked(now time.Time) bool {
+	return l.LockedUntil != nil && now.Before(*l.LockedUntil)
+}
+
+// a key password checks are counted under, and how many failures it allows
+type lockKey struct {
+	key       string
+	threshold int
+}
+
+// the keys a password check for identifier from ip counts against. Keys
+// with a threshold of 0 are left out, disabling them.
+func (sm *SessionManager) lockKeys(ip string, identifier string) []lockKey {
+	keys := make([]lockKey, 0, 2)
+	if sm.lockout.IdentifierThreshold > 0 {
+		keys = append(keys, lockKey{"id:" + identifier, sm.lockout.IdentifierThreshold})
+	}
+	if sm.lockout.IPThreshold > 0 && ip != "" {
+		keys = append(keys, lockKey{"ip:" + ip, sm.lockout.IPThreshold})
+	}
+	return keys
+}
+
+// a password check counted against a key before the password is compared,
+// and what the count was before, so it can be taken back
+type lockAttempt struct {
+	key      lockKey
+	previous Lockout
+	counted  Lockout
+}
+
+// counts a password check as a failure against each of keys before the
+// password is compared, so concurrent checks can't all get in under the
+// threshold. The check that reaches a key's threshold locks it out straight
+// away. Returns a locked_out APIError, counting nothing, if any of keys is
+// locked out already.
+func (sm *SessionManager) reserveAttempt(ctx context.Context, keys []lockKey) ([]lockAttempt, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	attempts := make([]lockAttempt, 0, len(keys))
+	for _, key := range keys {
+		// usually there are no earlier failures, which takes one statement
+		attempt := lockAttempt{key: key, previous: Lockout{Key: key.key}}
+		attempt.counted = sm.countFailure(attempt.previous, key, now)
+		inserted, err := sm.db.InsertLockout(ctx, attempt.counted)
+
+		var lockedOut error
+		if err == nil && !inserted {
+			err = sm.db.UpdateLockout(ctx, key.key, func(lockout *Lockout) {
+				if lockout.isLocked(now) {
+					lockedOut = lockedOutError(lockout.LockedUntil.Sub(now))
+					return
+				}
+				attempt.previous = *lockout
+				*lockout = sm.countFailure(*lockout, key, now)
+				attempt.counted = *lockout
+			})
+		}
+		if err == nil {
+			err = lockedOut
+		}
+		if err != nil {
+			// don't leave the keys before this one counted
+			if releaseErr := sm.releaseAttempts(ctx, attempts); releaseErr != nil {
+				log.Print(releaseErr)
+			}
+			return nil, err
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts, nil
+}
+
+// returns lockout with one more failure at now, locked out if that reaches
+// the key's threshold
+func (sm *SessionManager) countFailure(lockout Lockout, key lockKey, now time.Time) Lockout {
+	if sm.lockoutExpired(&lockout, now) {
+		lockout = Lockout{Key: key.key}
+	}
+	lockout.Failures++
+	lockout.LastFailure = now
+	if lockout.Failures >= key.threshold {
+		until := now.Add(sm.lockoutDelay(lockout.Failures - key.threshold))
+		lockout.LockedUntil = &until
+	}
+	return lockout
+}
+
+// takes back attempts, for a password that turned out to be right. A key
+// locked out by the attempt is unlocked, unless a failure since has changed
+// it.
+func (sm *SessionManager) releaseAttempts(ctx context.Context, attempts []lockAttempt) error {
+	for _, attempt := range attempts {
+		if attempt.previous.Failures == 0 {
+			// there were no failures before, so unless there have been some
+			// since, there is nothing to keep
+			released, err := sm.db.ReleaseLockout(ctx, attempt.key.key, attempt.counted.Failures)
+			if err != nil {
+				return err
+			} else if released {
+				continue
+			}
+		}
+
+		err := sm.db.UpdateLockout(ctx, attempt.key.key, func(lockout *Lockout) {
+			if lockout.Failures == 0 {
+				return
+			}
+			lockout.Failures--
+			if lockout.LastFailure.Equal(attempt.counted.LastFailure) &&
+				sameTime(lockout.LockedUntil, attempt.counted.LockedUntil) {
+				lockout.LastFailure = attempt.previous.LastFailure
+				lockout.LockedUntil = attempt.previous.LockedUntil
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logs the keys attempts locked out, once the password is known to be wrong
+func logLockouts(attempts []lockAttempt) {
+	for _, attempt := range attempts {
+		counted := attempt.counted
+		if counted.LockedUntil != nil && !sameTime(counted.LockedUntil, attempt.previous.LockedUntil) {
+			lockoutsStarted.Inc()
+			log.Printf("locked out %s until %s after %d failed password checks",
+				counted.Key, counted.LockedUntil.Format(time.RFC3339), counted.Failures)
+		}
+	}
+}
+
+func sameTime(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// returns true if there hasn't been a failure, or a lockout in force, for
+// the longest lockout delay, so the failures can be forgotten
+func (sm *SessionManager) lockoutExpired(lockout *Lockout, now time.Time) bool {
+	quietSince := lockout.LastFailure
+	if lockout.LockedUntil != nil && lockout.LockedUntil.After(quietSince) {
+		quietSince = *lockout.LockedUntil
+	}
+	return now.Sub(quietSince) > sm.lockout.MaxDelay.Duration
+}
+
+// how long to lock out for, after `extra` failures beyond the threshold.
+// Doubles each time, up to the maximum.
+func (sm *SessionManager) lockoutDelay(extra int) time.Duration {
+	delay := sm.lockout.BaseDelay.Duration
+	for i := 0; i < extra && delay < sm.lockout.MaxDelay.Duration; i++ {
+		delay *= 2
+	}
+	if delay > sm.lockout.MaxDelay.Duration {
+		delay = sm.lockout.MaxDelay.Duration
+	}
+	return delay
+}
+
+func lockedOutError(retryAfter time.Duration) *APIError {
+	return &APIError{Code: codeLockedOut,
+		Reason: "Too many failed attempts, please try again later.", retryAfter: retryAfter}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// returns a session manager on SQLite, with user "user" signed up
+func newLockoutTestSessionManager(t *testing.T, lockout LockoutConfig) *SessionManager {
+	db := newTestSQLiteDB(t)
+	digest, _ := bcrypt.GenerateFromPassword([]byte("battery horse staple"), bcrypt.MinCost)
+	if err := db.InsertUser(context.Background(), "user", digest); err != nil {
+		t.Fatal(err)
+	}
+	return newSessionManager(db, []byte("test secret"), time.Hour, lockout,
+		newPasswordHasher(PasswordConfig{BcryptCost: bcrypt.MinCost}))
+}
+
+func TestLockoutAfterRepeatedFailures(t *testing.T) {
+	sm := newLockoutTestSessionManager(t, LockoutConfig{IdentifierThreshold: 3, IPThreshold: 10,
+		BaseDelay: Duration{time.Minute}, MaxDelay: Duration{time.Hour}})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		valid, err := sm.checkPassword(ctx, "203.0.113.7", "user", "wrong")
+		assert.NoError(t, err)
+		assert.False(t, valid)
+	}
+
+	// even the right password is refused now
+	_, err := sm.checkPassword(ctx, "198.51.100.4", "user", "battery horse staple")
+	var apiErr *APIError
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, codeLockedOut, apiErr.Code)
+		assert.Equal(t, http.StatusTooManyRequests, apiErr.status())
+		assert.InDelta(t, time.Minute.Seconds(), apiErr.retryAfter.Seconds(), 2)
+	}
+
+	// the IP isn't locked out yet, so other identifiers are unaffected
+	valid, err := sm.checkPassword(ctx, "203.0.113.7", "someone-else", "wrong")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	lockouts, err := sm.db.ListLockouts(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, lockouts, 3)
+
+	cleared, err := sm.db.ClearLockout(ctx, "id:user")
+	assert.NoError(t, err)
+	assert.True(t, cleared)
+	valid, err = sm.checkPassword(ctx, "198.51.100.4", "user", "battery horse staple")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+}
+
+func TestLockoutByIP(t *testing.T) {
+	sm := newLockoutTestSessionManager(t, LockoutConfig{IPThreshold: 2,
+		BaseDelay: Duration{time.Minute}, MaxDelay: Duration{time.Hour}})
+	ctx := context.Background()
+
+	sm.checkPassword(ctx, "203.0.113.7", "a", "wrong")
+	sm.checkPassword(ctx, "203.0.113.7", "b", "wrong")
+
+	_, err := sm.checkPassword(ctx, "203.0.113.7", "user", "battery horse staple")
+	assert.Error(t, err)
+	valid, err := sm.checkPassword(ctx, "198.51.100.4", "user", "battery horse staple")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+}
+
+func TestLockoutConcurrentFailures(t *testing.T) {
+	sm := newLockoutTestSessionManager(t, LockoutConfig{IdentifierThreshold: 3,
+		BaseDelay: Duration{time.Minute}, MaxDelay: Duration{time.Hour}})
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	compared := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := sm.checkPassword(ctx, "203.0.113.7", "user", "wrong")
+			if err == nil {
+				mu.Lock()
+				compared++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// only as many guesses as the threshold get to the password
+	assert.Equal(t, 3, compared)
+	lockout, err := sm.db.GetLockout(ctx, "id:user")
+	if assert.NoError(t, err) && assert.NotNil(t, lockout) {
+		assert.Equal(t, 3, lockout.Failures)
+		assert.NotNil(t, lockout.LockedUntil)
+	}
+}
+
+func TestSuccessLeavesNothingRecorded(t *testing.T) {
+	sm := newLockoutTestSessionManager(t, LockoutConfig{IdentifierThreshold: 3, IPThreshold: 10,
+		BaseDelay: Duration{time.Minute}, MaxDelay: Duration{time.Hour}})
+	ctx := context.Background()
+
+	valid, err := sm.checkPassword(ctx, "203.0.113.7", "user", "battery horse staple")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	lockouts, err := sm.db.ListLockouts(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, lockouts)
+}
+
+func TestSuccessDoesNotCountAgainstIP(t *testing.T) {
+	sm := newLockoutTestSessionManager(t, LockoutConfig{IPThreshold: 2,
+		BaseDelay: Duration{time.Minute}, MaxDelay: Duration{time.Hour}})
+	ctx := context.Background()
+
+	sm.checkPassword(ctx, "203.0.113.7", "a", "wrong")
+	for i := 0; i < 3; i++ {
+		valid, err := sm.checkPassword(ctx, "203.0.113.7", "user", "battery horse staple")
+		assert.NoError(t, err)
+		assert.True(t, valid)
+	}
+
+	lockout, err := sm.db.GetLockout(ctx, "ip:203.0.113.7")
+	if assert.NoError(t, err) && assert.NotNil(t, lockout) {
+		assert.Equal(t, 1, lockout.Failures)
+		assert.Nil(t, lockout.LockedUntil)
+	}
+}
+
+func TestSuccessClearsIdentifierFailures(t *testing.T) {
+	sm := newLockoutTestSessionManager(t, LockoutConfig{IdentifierThreshold: 3,
+		BaseDelay: Duration{time.Minute}, MaxDelay: Duration{time.Hour}})
+	ctx := context.Background()
+
+	sm.checkPassword(ctx, "203.0.113.7", "user", "wrong")
+	sm.checkPassword(ctx, "203.0.113.7", "user", "wrong")
+	valid, _ := sm.checkPassword(ctx, "203.0.113.7", "user", "battery horse staple")
+	assert.True(t, valid)
+
+	lockout, err := sm.db.GetLockout(ctx, "id:user")
+	assert.NoError(t, err)
+	assert.Nil(t, lockout)
+}
+
+func TestLockoutDelayDoubles(t *testing.T) {
+	sm := newSessionManager(nil, nil, time.Hour, LockoutConfig{
+		BaseDelay: Duration{30 * time.Second}, MaxDelay: Duration{5 * time.Minute}}, nil)
+
+	assert.Equal(t, 30*time.Second, sm.lockoutDelay(0))
+	assert.Equal(t, time.Minute, sm.lockoutDelay(1))
+	assert.Equal(t, 4*time.Minute, sm.lockoutDelay(3))
+	assert.Equal(t, 5*time.Minute, sm.lockoutDelay(4))
+	assert.Equal(t, 5*time.Minute, sm.lockoutDelay(100))
+}
+
+func TestLockoutFailuresExpire(t *testing.T) {
+	sm := newSessionManager(nil, nil, time.Hour, LockoutConfig{MaxDelay: Duration{time.Hour}}, nil)
+	now := time.Now()
+	until := now.Add(-30 * time.Minute)
+
+	assert.False(t, sm.lockoutExpired(&Lockout{LastFailure: now.Add(-time.Minute)}, now))
+	assert.True(t, sm.lockoutExpired(&Lockout{LastFailure: now.Add(-2 * time.Hour)}, now))
+	// counted from the end of the lockout
+	assert.False(t, sm.lockoutExpired(&Lockout{LastFailure: now.Add(-2 * time.Hour),
+		LockedUntil: &until}, now))
+}
@@ -1,57 +1,162 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
-	"fmt"
 	"html/template"
 	"log"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"golang.org/x/crypto/acme/autocert"
-
-	// needed but not directly used
-	_ "github.com/go-sql-driver/mysql"
 )
 
-const PORT = 443
-
-// this is the address & port where the SQL database can be accessed,
-// which is likely on the same machine
-const ADDRESS = "178.79.172.202:3306"
+func main() {
+	cfg, args, err := loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
 
-var sqlPassword string = os.Getenv("SQL_PASSWORD")
-var domain string = os.Getenv("DOMAIN_NAME")
+	// e.g. `nudgeme migrate up`, otherwise serve
+	if len(args) > 0 {
+		if err := runCommand(cfg, args); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
 
-func main() {
-	db := getDBConn("team26")
-	defer db.Close()
+	// cancelled on SIGINT/SIGTERM, stopping the background workers
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	var workers sync.WaitGroup
 
-	var mydb DataSource = &MyDB{db}
+	dbs := openDatabases(cfg.Database, true)
+	sm := newSessionManager(dbs.mydb, getSessionSecret(cfg.SessionSecret), sessionTTL,
+		cfg.Lockout, newPasswordHasher(cfg.Passwords))
 
 	// setup web
 	e := echo.New()
+	e.HTTPErrorHandler = handleHTTPError
 
-	e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(domain)
-	e.AutoTLSManager.Cache = autocert.DirCache("/var/www/.cache")
-
+	if err := setupIPExtractor(e, cfg.TLS); err != nil {
+		log.Fatal(err)
+	}
 	e.Use(middleware.Logger())
+	e.Use(metricsMiddleware)
 	e.Use(middleware.Recover())
 	e.Use(middleware.Gzip())
 
 	setupTemplate(e)
-	setupRoutes(e, db, mydb)
+	setupRoutes(e, cfg, dbs, sm)
+	initTemplateCache(ctx, &workers, dbs.main, dbs.mock,
+		cfg.TemplateRefresh.Duration, cfg.Database.QueryTimeout.Duration)
+	startMessageSweeper(ctx, &workers, dbs.mydb, cfg.MessageTTL.SweepInterval.Duration)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- startServer(e, cfg)
+	}()
+
+	failed := false
+	select {
+	case err := <-serverErr:
+		// couldn't start, e.g. the address is in use
+		log.Print(err)
+		failed = true
+	case <-ctx.Done():
+		log.Print("shutting down")
+	}
+	stop()
+
+	// stop accepting connections and wait for in-flight requests, then for
+	// the workers, before closing the databases they use
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Print(err)
+	}
+	workers.Wait()
+	dbs.Close()
 
-	// NOTE: since we are using HTTPS through Auto TLS, we have to use a
-	// domain name for the server to work
+	if failed {
+		os.Exit(1)
+	}
+}
 
-	e.Logger.Fatal(e.StartAutoTLS(fmt.Sprintf(":%d", PORT)))
+// the database handles in use, which depend on DB_DRIVER
+type databases struct {
+	mydb DataSource
+	main *sql.DB
+	mock *sql.DB // holds MOCK_DATA, may be the same as main
+}
+
+// opens the databases. If migrate is true pending migrations are applied to
+// an SQLite database; MySQL is only migrated through `nudgeme migrate`.
+func openDatabases(cfg DatabaseConfig, migrate bool) *databases {
+	switch cfg.Driver {
+	case "sqlite":
+		var sqliteDB *SQLiteDB
+		var err error
+		if migrate {
+			sqliteDB, err = openSQLiteDB(cfg.SQLitePath)
+		} else {
+			var db *sql.DB
+			db, err = openSQLiteConn(cfg.SQLitePath)
+			sqliteDB = &SQLiteDB{MyDB{database: db}}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		sqliteDB.queryTimeout = cfg.QueryTimeout.Duration
+		// mock data is kept in the same file
+		return &databases{sqliteDB, sqliteDB.database, sqliteDB.database}
+	case "mysql":
+		db := getDBConn(cfg, cfg.Name)
+		mydb := &MyDB{database: db, queryTimeout: cfg.QueryTimeout.Duration}
+		return &databases{mydb, db, getDBConn(cfg, cfg.MockName)}
+	default:
+		log.Fatalf("unknown database driver %q", cfg.Driver)
+		return nil
+	}
+}
+
+// returns each database along with the migrations that build its schema
+func (dbs *databases) migrationTargets() []migrationTarget {
+	if dbs.main == dbs.mock {
+		return []migrationTarget{{dbs.main, "sqlite"}}
+	}
+	return []migrationTarget{{dbs.main, "mysql"}, {dbs.mock, "mysql_mock"}}
+}
+
+func (dbs *databases) Close() {
+	dbs.main.Close()
+	dbs.mock.Close()
 }
 
 // opens and returns connection to DB
-func getDBConn(dbName string) *sql.DB {
-	db, err1 := sql.Open("mysql", fmt.Sprintf("root:%s@tcp(%s)/%s", sqlPassword, ADDRESS, dbName))
+func getDBConn(cfg DatabaseConfig, dbName string) *sql.DB {
+	dsn := mysql.NewConfig()
+	dsn.User = cfg.User
+	dsn.Passwd = cfg.Password
+	dsn.Net = "tcp"
+	dsn.Addr = cfg.Address
+	dsn.DBName = dbName
+	dsn.ParseTime = true
+	// times are stored in UTC, so read them back as UTC and have the server's
+	// own time functions agree
+	dsn.Loc = time.UTC
+	dsn.Params = map[string]string{"time_zone": "'+00:00'"}
+
+	db, err1 := sql.Open("mysql", dsn.FormatDSN())
 	if err1 != nil {
 		log.Fatal(err1)
 	}
@@ -62,6 +167,20 @@ func getDBConn(dbName string) *sql.DB {
 	return db
 }
 
+// returns the key used to sign session tokens. If none is configured a
+// random one is used, so tokens won't survive a restart.
+func getSessionSecret(sessionSecret string) []byte {
+	if sessionSecret != "" {
+		return []byte(sessionSecret)
+	}
+	log.Print("no session secret set, sessions will be invalidated on restart")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal(err)
+	}
+	return secret
+}
+
 // registers the templates with the rendered
 func setupTemplate(e *echo.Echo) {
 	t := &Template{templates: template.Must(template.ParseGlob("template/*.html"))}
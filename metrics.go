@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics exported on /metrics, in the Prometheus text format
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nudgeme_http_requests_total",
+		Help: "HTTP requests handled, by route and status code.",
+	}, []string{"method", "route", "status"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nudgeme_http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	passwordCheckDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name: "nudgeme_password_check_duration_seconds",
+		Help: "Time taken to verify a password, including the database lookup.",
+		// bcrypt takes tens of milliseconds
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 10),
+	})
+	passwordCheckFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nudgeme_password_check_failures_total",
+		Help: "Password checks that failed, because of a wrong password or an error.",
+	})
+	lockoutsStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nudgeme_lockouts_total",
+		Help: "Identifiers and IP addresses locked out after repeated password failures.",
+	})
+
+	rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nudgeme_rate_limited_requests_total",
+		Help: "Requests refused for exceeding a rate limit, by route group.",
+	}, []string{"group"})
+
+	wellbeingRecordsInserted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nudgeme_wellbeing_records_inserted_total",
+		Help: "Wellbeing records added to the scores table.",
+	})
+
+	mapRefreshDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "nudgeme_map_refresh_duration_seconds",
+		Help:    "Time taken to recompute the /map data.",
+		Buckets: prometheus.DefBuckets,
+	})
+	mapRefreshErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nudgeme_map_refresh_errors_total",
+		Help: "Failed attempts to recompute the /map data.",
+	})
+
+	messagesExpired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nudgeme_messages_expired_total",
+		Help: "Messages deleted by the sweeper without being acked, by channel.",
+	}, []string{"channel"})
+	messageSweepDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "nudgeme_message_sweep_duration_seconds",
+		Help:    "Time taken to delete expired messages from every mailbox table.",
+		Buckets: prometheus.DefBuckets,
+	})
+	messageSweepErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nudgeme_message_sweep_errors_total",
+		Help: "Failed attempts to delete expired messages from a mailbox table, or expired sessions.",
+	})
+	sessionsExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nudgeme_sessions_expired_total",
+		Help: "Expired sessions deleted by the sweeper.",
+	})
+
+	pendingMessagesDesc = prometheus.NewDesc("nudgeme_pending_messages",
+		"Messages waiting to be acked, by channel.", []string{"channel"}, nil)
+)
+
+// returns a registry holding our metrics and the standard Go process ones
+func newMetricsRegistry(db DataSource) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		httpRequests, httpRequestDuration,
+		passwordCheckDuration, passwordCheckFailures, lockoutsStarted,
+		rateLimitedRequests,
+		wellbeingRecordsInserted,
+		mapRefreshDuration, mapRefreshErrors,
+		messagesExpired, messageSweepDuration, messageSweepErrors, sessionsExpired,
+		&mailboxCollector{db},
+	)
+	return registry
+}
+
+// serves the metrics in registry
+func handleMetrics(registry *prometheus.Registry) echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+}
+
+// middleware counting and timing requests by route
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		// the registered path rather than the URL, so IDs etc. don't
+		// create a label each
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request().Method
+
+		// an error hasn't been written to the response yet
+		status := c.Response().Status
+		if err != nil {
+			status = toAPIError(err).status()
+		}
+
+		httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// reports how many messages are pending in each mailbox table when scraped
+type mailboxCollector struct {
+	db DataSource
+}
+
+func (mc *mailboxCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pendingMessagesDesc
+}
+
+func (mc *mailboxCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, tableName := range []string{messageTableName, nudgeTableName} {
+		// the scrape doesn't give us a context, the query timeout still applies
+		count, err := mc.db.CountMessages(context.Background(), tableName)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(pendingMessagesDesc, prometheus.GaugeValue,
+			float64(count), channelNames[tableName])
+	}
+}
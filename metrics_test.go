@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMetricsMiddlewareCountsByRoute(t *testing.T) {
+	e := echo.New()
+	e.Use(metricsMiddleware)
+	e.GET("/user/:id", func(c echo.Context) error { return c.String(http.StatusOK, "") })
+	before := testutil.ToFloat64(httpRequests.WithLabelValues("GET", "/user/:id", "200"))
+
+	for _, path := range []string{"/user/1", "/user/2"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	after := testutil.ToFloat64(httpRequests.WithLabelValues("GET", "/user/:id", "200"))
+	assert.Equal(t, 2.0, after-before)
+}
+
+func TestMetricsPendingMessages(t *testing.T) {
+	fakeDB := new(FakeDB)
+	fakeDB.On("CountMessages", mock.Anything, messageTableName).Return(int64(4), nil)
+	fakeDB.On("CountMessages", mock.Anything, nudgeTableName).Return(int64(1), nil)
+
+	e := echo.New()
+	e.GET("/metrics", handleMetrics(newMetricsRegistry(fakeDB)))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `nudgeme_pending_messages{channel="message"} 4`)
+	assert.Contains(t, rec.Body.String(), `nudgeme_pending_messages{channel="nudge"} 1`)
+	assert.Contains(t, rec.Body.String(), "nudgeme_password_check_duration_seconds")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The schema is built by numbered migrations in migrations/<set>, named like
+// `0002_add_something.up.sql` with a matching `.down.sql` to undo it. Each
+// statement must end with a semicolon at the end of a line.
+//
+// Sets are "mysql" for the main MySQL database, "mysql_mock" for the MySQL
+// database holding MOCK_DATA and "sqlite" for the SQLite file, which holds
+// everything.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// whether a migration has been applied to a database
+type migrationState struct {
+	migration
+	appliedAt *time.Time
+}
+
+// a database and the migration set that builds its schema
+type migrationTarget struct {
+	db  *sql.DB
+	set string
+}
+
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version (
+	version INT NOT NULL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+// returns the migrations in a set, oldest first
+func loadMigrations(set string) ([]migration, error) {
+	dir := path.Join("migrations", set)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var direction string
+		if strings.HasSuffix(fileName, ".up.sql") {
+			direction = "up"
+		} else if strings.HasSuffix(fileName, ".down.sql") {
+			direction = "down"
+		} else {
+			continue
+		}
+
+		name := strings.TrimSuffix(fileName, "."+direction+".sql")
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: bad version: %w", fileName, err)
+		}
+		contents, err := migrationFiles.ReadFile(path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		} else if m.name != name {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", m.name, name, version)
+		}
+		if direction == "up" {
+			m.up = string(contents)
+		} else {
+			m.down = string(contents)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %s needs both an up and a down file", m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// applies every pending migration in set, returning how many were applied
+func migrateUp(db *sql.DB, set string) (int, error) {
+	states, err := migrationStatus(db, set)
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, state := range states {
+		if state.appliedAt != nil {
+			continue
+		}
+		err := runMigration(db, state.up,
+			"INSERT INTO schema_version (version, name) VALUES (?, ?)",
+			state.version, state.name)
+		if err != nil {
+			return applied, fmt.Errorf("migration %s: %w", state.name, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// reverts the latest `steps` applied migrations in set, returning how many
+// were reverted
+func migrateDown(db *sql.DB, set string, steps int) (int, error) {
+	states, err := migrationStatus(db, set)
+	if err != nil {
+		return 0, err
+	}
+
+	reverted := 0
+	for i := len(states) - 1; i >= 0 && reverted < steps; i-- {
+		state := states[i]
+		if state.appliedAt == nil {
+			continue
+		}
+		err := runMigration(db, state.down,
+			"DELETE FROM schema_version WHERE version = ?", state.version)
+		if err != nil {
+			return reverted, fmt.Errorf("migration %s: %w", state.name, err)
+		}
+		reverted++
+	}
+	return reverted, nil
+}
+
+// returns every migration in set, and when it was applied if it has been
+func migrationStatus(db *sql.DB, set string) ([]migrationState, error) {
+	migrations, err := loadMigrations(set)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schemaVersionTable); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appliedAt := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		appliedAt[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	states := make([]migrationState, len(migrations))
+	for i, m := range migrations {
+		states[i].migration = m
+		if at, ok := appliedAt[m.version]; ok {
+			states[i].appliedAt = &at
+		}
+	}
+	return states, nil
+}
+
+// runs the statements in script followed by the bookkeeping query, in a
+// transaction. MySQL commits after each CREATE/ALTER/DROP regardless, so a
+// failed MySQL migration may need tidying up by hand.
+func runMigration(db *sql.DB, script string, bookkeeping string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range splitStatements(script) {
+		if _, err := tx.Exec(statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec(bookkeeping, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// splits an SQL script into statements, on semicolons at the end of lines.
+// Comment lines are dropped.
+func splitStatements(script string) []string {
+	statements := make([]string, 0)
+	var current strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSpace(current.String()))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationSetsLoad(t *testing.T) {
+	for _, set := range []string{"mysql", "mysql_mock", "sqlite"} {
+		migrations, err := loadMigrations(set)
+		if assert.NoError(t, err, set) {
+			assert.NotEmpty(t, migrations, set)
+			for i, m := range migrations {
+				assert.Equal(t, i+1, m.version, "%s versions should have no gaps", set)
+			}
+		}
+	}
+}
+
+func TestSQLiteMigrateUpAndDown(t *testing.T) {
+	db, err := openSQLiteConn(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrations, _ := loadMigrations("sqlite")
+
+	applied, err := migrateUp(db, "sqlite")
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), applied)
+
+	// nothing left to do the second time
+	applied, err = migrateUp(db, "sqlite")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, applied)
+
+	reverted, err := migrateDown(db, "sqlite", len(migrations))
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), reverted)
+
+	states, err := migrationStatus(db, "sqlite")
+	assert.NoError(t, err)
+	for _, state := range states {
+		assert.Nil(t, state.appliedAt, state.name)
+	}
+	_, err = db.Exec("SELECT COUNT(*) FROM users")
+	assert.Error(t, err, "users should have been dropped")
+
+	applied, err = migrateUp(db, "sqlite")
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), applied)
+}
+
+func TestSQLiteMigrationDedupesPendingMessages(t *testing.T) {
+	db, err := openSQLiteConn(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := migrateUp(db, "sqlite"); err != nil {
+		t.Fatal(err)
+	}
+	// back to before the unique index, 0008, when duplicates could be made
+	migrations, _ := loadMigrations("sqlite")
+	steps := 0
+	for _, m := range migrations {
+		if m.version >= 8 {
+			steps++
+		}
+	}
+	if _, err := migrateDown(db, "sqlite", steps); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{`"old"`, `"new"`} {
+		_, err := db.Exec("INSERT INTO unread_messages (identifier_from, identifier_to, data) "+
+			"VALUES ('a', 'user', ?)", data)
+		assert.NoError(t, err)
+	}
+
+	_, err = migrateUp(db, "sqlite")
+	assert.NoError(t, err)
+	var data string
+	assert.NoError(t, db.QueryRow("SELECT data FROM unread_messages").Scan(&data))
+	assert.Equal(t, `"new"`, data)
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- a comment
+CREATE TABLE a (
+    x INT
+);
+
+DROP TABLE b;`
+	assert.Equal(t, []string{"CREATE TABLE a (\n    x INT\n);", "DROP TABLE b;"},
+		splitStatements(script))
+}
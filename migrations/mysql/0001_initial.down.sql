@@ -0,0 +1,4 @@
+DROP TABLE scores;
+DROP TABLE user_nudge;
+DROP TABLE unread_messages;
+DROP TABLE users;
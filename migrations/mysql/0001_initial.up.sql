@@ -0,0 +1,30 @@
+-- the schema as it was before migrations were introduced. IF NOT EXISTS so
+-- this can be applied to the existing database, which has these tables
+-- already; everything added since is in later migrations.
+CREATE TABLE IF NOT EXISTS users (
+    identifier VARCHAR(255) NOT NULL PRIMARY KEY,
+    password VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS unread_messages (
+    identifier_from VARCHAR(255) NOT NULL,
+    identifier_to VARCHAR(255) NOT NULL,
+    data JSON,
+    INDEX (identifier_to)
+);
+
+CREATE TABLE IF NOT EXISTS user_nudge (
+    identifier_from VARCHAR(255) NOT NULL,
+    identifier_to VARCHAR(255) NOT NULL,
+    data JSON,
+    INDEX (identifier_to)
+);
+
+CREATE TABLE IF NOT EXISTS scores (
+    postCode VARCHAR(8),
+    wellbeingScore SMALLINT,
+    weeklySteps INT,
+    errorRate INT,
+    supportCode VARCHAR(255),
+    date_sent DATE
+);
@@ -0,0 +1,3 @@
+DROP TABLE sessions;
+ALTER TABLE user_nudge DROP COLUMN created_at, DROP COLUMN id;
+ALTER TABLE unread_messages DROP COLUMN created_at, DROP COLUMN id;
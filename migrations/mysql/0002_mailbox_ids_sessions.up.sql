@@ -0,0 +1,15 @@
+-- a server-assigned id and timestamp for each pending message, and the
+-- table login sessions are kept in
+ALTER TABLE unread_messages
+    ADD COLUMN id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY FIRST,
+    ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+ALTER TABLE user_nudge
+    ADD COLUMN id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY FIRST,
+    ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+CREATE TABLE sessions (
+    id VARCHAR(64) NOT NULL PRIMARY KEY,
+    identifier VARCHAR(255) NOT NULL,
+    expires_at DATETIME NOT NULL,
+    INDEX (identifier)
+);
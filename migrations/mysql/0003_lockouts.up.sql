@@ -0,0 +1,7 @@
+-- failed password attempts, by identifier ("id:...") or IP address ("ip:...")
+CREATE TABLE lockouts (
+    lock_key VARCHAR(255) NOT NULL PRIMARY KEY,
+    failures INT NOT NULL,
+    last_failure DATETIME NOT NULL,
+    locked_until DATETIME NULL
+);
@@ -0,0 +1,11 @@
+-- users' RSA public keys. The current one has no replaced_at, older ones are
+-- kept so friends can tell the key changed.
+CREATE TABLE public_keys (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    identifier VARCHAR(255) NOT NULL,
+    pem TEXT NOT NULL,
+    fingerprint CHAR(64) NOT NULL,
+    created_at DATETIME NOT NULL,
+    replaced_at DATETIME NULL,
+    INDEX (identifier)
+);
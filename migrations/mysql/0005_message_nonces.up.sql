@@ -0,0 +1,7 @@
+-- signatures of signed messages already accepted, hashed, kept until their
+-- timestamp is too old to be accepted again
+CREATE TABLE message_nonces (
+    nonce CHAR(64) NOT NULL PRIMARY KEY,
+    expires_at DATETIME NOT NULL,
+    INDEX (expires_at)
+);
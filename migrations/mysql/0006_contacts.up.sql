@@ -0,0 +1,11 @@
+-- contacts between pairs of users, one row per pair with identifier_a sorting
+-- before identifier_b. Pending until whoever wasn't requested_by accepts.
+CREATE TABLE contacts (
+    identifier_a VARCHAR(255) NOT NULL,
+    identifier_b VARCHAR(255) NOT NULL,
+    requested_by VARCHAR(255) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (identifier_a, identifier_b),
+    INDEX (identifier_b)
+);
@@ -0,0 +1,21 @@
+-- users who may not send to blocker
+CREATE TABLE blocks (
+    blocker VARCHAR(255) NOT NULL,
+    blocked VARCHAR(255) NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (blocker, blocked),
+    INDEX (blocked)
+);
+
+-- messages and nudges reported for moderators to review, open until resolved
+CREATE TABLE reports (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    reporter VARCHAR(255) NOT NULL,
+    reported VARCHAR(255) NOT NULL,
+    channel VARCHAR(16) NOT NULL,
+    message_id BIGINT NOT NULL,
+    reason TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    resolved_at DATETIME NULL,
+    INDEX (resolved_at)
+);
@@ -0,0 +1 @@
+ALTER TABLE unread_messages DROP INDEX unread_messages_pair;
@@ -0,0 +1,7 @@
+-- at most one pending message per sender and recipient, so AddMessage can
+-- overwrite it in one statement. Duplicates left by the old check-then-insert
+-- are dropped first, keeping the newest.
+DELETE older FROM unread_messages older
+    JOIN unread_messages newer ON older.identifier_from = newer.identifier_from
+        AND older.identifier_to = newer.identifier_to AND older.id < newer.id;
+ALTER TABLE unread_messages ADD UNIQUE INDEX unread_messages_pair (identifier_from, identifier_to);
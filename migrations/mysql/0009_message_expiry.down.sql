@@ -0,0 +1,2 @@
+ALTER TABLE user_nudge DROP COLUMN expires_at;
+ALTER TABLE unread_messages DROP COLUMN expires_at;
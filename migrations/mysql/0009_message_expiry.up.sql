@@ -0,0 +1,9 @@
+-- when each pending message or nudge is deleted if it hasn't been acked, NULL
+-- for never. Those already pending get the default TTLs.
+ALTER TABLE unread_messages ADD COLUMN expires_at DATETIME NULL, ADD INDEX (expires_at);
+ALTER TABLE user_nudge ADD COLUMN expires_at DATETIME NULL, ADD INDEX (expires_at);
+-- created_at is a TIMESTAMP, read in the session's time zone, and expiry
+-- times are UTC
+SET time_zone = '+00:00';
+UPDATE unread_messages SET expires_at = created_at + INTERVAL 30 DAY;
+UPDATE user_nudge SET expires_at = created_at + INTERVAL 7 DAY;
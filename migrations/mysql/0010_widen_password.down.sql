@@ -0,0 +1,2 @@
+-- left wide, since narrowing it would cut off the Argon2id digests stored
+-- since
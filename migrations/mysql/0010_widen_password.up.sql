@@ -0,0 +1,3 @@
+-- Argon2id digests are about 97 bytes, and the existing users table may have
+-- been made for 60 byte bcrypt ones
+ALTER TABLE users MODIFY password VARCHAR(255) NOT NULL;
@@ -0,0 +1,3 @@
+-- what the reported message said, copied when it was reported since the
+-- message itself is deleted once acked or expired
+ALTER TABLE reports ADD COLUMN message_data TEXT NULL;
@@ -0,0 +1 @@
+DROP TABLE MOCK_DATA;
@@ -0,0 +1,9 @@
+-- fixed data for the map demo, kept in its own database
+CREATE TABLE IF NOT EXISTS MOCK_DATA (
+    postCode VARCHAR(8),
+    wellbeingScore SMALLINT,
+    weeklySteps INT,
+    errorRate INT,
+    supportCode VARCHAR(255),
+    date_sent DATE
+);
@@ -0,0 +1,5 @@
+DROP TABLE MOCK_DATA;
+DROP TABLE scores;
+DROP TABLE user_nudge;
+DROP TABLE unread_messages;
+DROP TABLE users;
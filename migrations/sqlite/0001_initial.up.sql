@@ -0,0 +1,38 @@
+-- same tables as the MySQL database, plus MOCK_DATA which lives alongside
+-- the others rather than in its own database
+CREATE TABLE users (
+    identifier TEXT NOT NULL PRIMARY KEY,
+    password BLOB NOT NULL
+);
+
+CREATE TABLE unread_messages (
+    identifier_from TEXT NOT NULL,
+    identifier_to TEXT NOT NULL,
+    data TEXT
+);
+CREATE INDEX unread_messages_to ON unread_messages (identifier_to);
+
+CREATE TABLE user_nudge (
+    identifier_from TEXT NOT NULL,
+    identifier_to TEXT NOT NULL,
+    data TEXT
+);
+CREATE INDEX user_nudge_to ON user_nudge (identifier_to);
+
+CREATE TABLE scores (
+    postCode TEXT,
+    wellbeingScore INTEGER,
+    weeklySteps INTEGER,
+    errorRate INTEGER,
+    supportCode TEXT,
+    date_sent DATE
+);
+
+CREATE TABLE MOCK_DATA (
+    postCode TEXT,
+    wellbeingScore INTEGER,
+    weeklySteps INTEGER,
+    errorRate INTEGER,
+    supportCode TEXT,
+    date_sent DATE
+);
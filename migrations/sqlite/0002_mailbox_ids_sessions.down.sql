@@ -0,0 +1,23 @@
+DROP TABLE sessions;
+
+CREATE TABLE unread_messages_old (
+    identifier_from TEXT NOT NULL,
+    identifier_to TEXT NOT NULL,
+    data TEXT
+);
+INSERT INTO unread_messages_old (identifier_from, identifier_to, data)
+    SELECT identifier_from, identifier_to, data FROM unread_messages;
+DROP TABLE unread_messages;
+ALTER TABLE unread_messages_old RENAME TO unread_messages;
+CREATE INDEX unread_messages_to ON unread_messages (identifier_to);
+
+CREATE TABLE user_nudge_old (
+    identifier_from TEXT NOT NULL,
+    identifier_to TEXT NOT NULL,
+    data TEXT
+);
+INSERT INTO user_nudge_old (identifier_from, identifier_to, data)
+    SELECT identifier_from, identifier_to, data FROM user_nudge;
+DROP TABLE user_nudge;
+ALTER TABLE user_nudge_old RENAME TO user_nudge;
+CREATE INDEX user_nudge_to ON user_nudge (identifier_to);
@@ -0,0 +1,34 @@
+-- SQLite can't add a primary key to a table, so the mailbox tables are
+-- rebuilt with the id and created_at columns
+CREATE TABLE unread_messages_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    identifier_from TEXT NOT NULL,
+    identifier_to TEXT NOT NULL,
+    data TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO unread_messages_new (identifier_from, identifier_to, data)
+    SELECT identifier_from, identifier_to, data FROM unread_messages;
+DROP TABLE unread_messages;
+ALTER TABLE unread_messages_new RENAME TO unread_messages;
+CREATE INDEX unread_messages_to ON unread_messages (identifier_to);
+
+CREATE TABLE user_nudge_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    identifier_from TEXT NOT NULL,
+    identifier_to TEXT NOT NULL,
+    data TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO user_nudge_new (identifier_from, identifier_to, data)
+    SELECT identifier_from, identifier_to, data FROM user_nudge;
+DROP TABLE user_nudge;
+ALTER TABLE user_nudge_new RENAME TO user_nudge;
+CREATE INDEX user_nudge_to ON user_nudge (identifier_to);
+
+CREATE TABLE sessions (
+    id TEXT NOT NULL PRIMARY KEY,
+    identifier TEXT NOT NULL,
+    expires_at DATETIME NOT NULL
+);
+CREATE INDEX sessions_identifier ON sessions (identifier);
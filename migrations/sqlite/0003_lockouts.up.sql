@@ -0,0 +1,7 @@
+-- failed password attempts, by identifier ("id:...") or IP address ("ip:...")
+CREATE TABLE lockouts (
+    lock_key TEXT NOT NULL PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure DATETIME NOT NULL,
+    locked_until DATETIME
+);
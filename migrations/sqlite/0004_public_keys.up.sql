@@ -0,0 +1,11 @@
+-- users' RSA public keys. The current one has no replaced_at, older ones are
+-- kept so friends can tell the key changed.
+CREATE TABLE public_keys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    identifier TEXT NOT NULL,
+    pem TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    replaced_at DATETIME
+);
+CREATE INDEX public_keys_identifier ON public_keys (identifier);
@@ -0,0 +1,7 @@
+-- signatures of signed messages already accepted, hashed, kept until their
+-- timestamp is too old to be accepted again
+CREATE TABLE message_nonces (
+    nonce TEXT NOT NULL PRIMARY KEY,
+    expires_at DATETIME NOT NULL
+);
+CREATE INDEX message_nonces_expires_at ON message_nonces (expires_at);
@@ -0,0 +1,11 @@
+-- contacts between pairs of users, one row per pair with identifier_a sorting
+-- before identifier_b. Pending until whoever wasn't requested_by accepts.
+CREATE TABLE contacts (
+    identifier_a TEXT NOT NULL,
+    identifier_b TEXT NOT NULL,
+    requested_by TEXT NOT NULL,
+    status TEXT NOT NULL,
+    updated_at DATETIME NOT NULL,
+    PRIMARY KEY (identifier_a, identifier_b)
+);
+CREATE INDEX contacts_identifier_b ON contacts (identifier_b);
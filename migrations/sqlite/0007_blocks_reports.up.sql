@@ -0,0 +1,21 @@
+-- users who may not send to blocker
+CREATE TABLE blocks (
+    blocker TEXT NOT NULL,
+    blocked TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (blocker, blocked)
+);
+CREATE INDEX blocks_blocked ON blocks (blocked);
+
+-- messages and nudges reported for moderators to review, open until resolved
+CREATE TABLE reports (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    reporter TEXT NOT NULL,
+    reported TEXT NOT NULL,
+    channel TEXT NOT NULL,
+    message_id INTEGER NOT NULL,
+    reason TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    resolved_at DATETIME
+);
+CREATE INDEX reports_resolved_at ON reports (resolved_at);
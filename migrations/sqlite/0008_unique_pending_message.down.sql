@@ -0,0 +1 @@
+DROP INDEX unread_messages_pair;
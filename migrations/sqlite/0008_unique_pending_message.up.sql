@@ -0,0 +1,6 @@
+-- at most one pending message per sender and recipient, so AddMessage can
+-- overwrite it in one statement. Duplicates left by the old check-then-insert
+-- are dropped first, keeping the newest.
+DELETE FROM unread_messages WHERE id NOT IN
+    (SELECT MAX(id) FROM unread_messages GROUP BY identifier_from, identifier_to);
+CREATE UNIQUE INDEX unread_messages_pair ON unread_messages (identifier_from, identifier_to);
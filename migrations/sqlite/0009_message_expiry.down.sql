@@ -0,0 +1,30 @@
+-- this SQLite can't drop columns, so the tables are rebuilt without it
+DROP INDEX unread_messages_expires_at;
+DROP INDEX user_nudge_expires_at;
+
+CREATE TABLE unread_messages_old (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    identifier_from TEXT NOT NULL,
+    identifier_to TEXT NOT NULL,
+    data TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO unread_messages_old (id, identifier_from, identifier_to, data, created_at)
+    SELECT id, identifier_from, identifier_to, data, created_at FROM unread_messages;
+DROP TABLE unread_messages;
+ALTER TABLE unread_messages_old RENAME TO unread_messages;
+CREATE INDEX unread_messages_to ON unread_messages (identifier_to);
+CREATE UNIQUE INDEX unread_messages_pair ON unread_messages (identifier_from, identifier_to);
+
+CREATE TABLE user_nudge_old (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    identifier_from TEXT NOT NULL,
+    identifier_to TEXT NOT NULL,
+    data TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+INSERT INTO user_nudge_old (id, identifier_from, identifier_to, data, created_at)
+    SELECT id, identifier_from, identifier_to, data, created_at FROM user_nudge;
+DROP TABLE user_nudge;
+ALTER TABLE user_nudge_old RENAME TO user_nudge;
+CREATE INDEX user_nudge_to ON user_nudge (identifier_to);
@@ -0,0 +1,8 @@
+-- when each pending message or nudge is deleted if it hasn't been acked, NULL
+-- for never. Those already pending get the default TTLs.
+ALTER TABLE unread_messages ADD COLUMN expires_at DATETIME;
+ALTER TABLE user_nudge ADD COLUMN expires_at DATETIME;
+CREATE INDEX unread_messages_expires_at ON unread_messages (expires_at);
+CREATE INDEX user_nudge_expires_at ON user_nudge (expires_at);
+UPDATE unread_messages SET expires_at = datetime(created_at, '+30 days');
+UPDATE user_nudge SET expires_at = datetime(created_at, '+7 days');
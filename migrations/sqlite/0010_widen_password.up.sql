@@ -0,0 +1,2 @@
+-- nothing to do, SQLite doesn't limit the length of the password column. Kept
+-- so the versions match the MySQL set.
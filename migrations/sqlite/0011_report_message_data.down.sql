@@ -0,0 +1,20 @@
+-- this SQLite can't drop columns, so the table is rebuilt without it
+DROP INDEX reports_resolved_at;
+
+CREATE TABLE reports_old (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    reporter TEXT NOT NULL,
+    reported TEXT NOT NULL,
+    channel TEXT NOT NULL,
+    message_id INTEGER NOT NULL,
+    reason TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    resolved_at DATETIME
+);
+INSERT INTO reports_old (id, reporter, reported, channel, message_id, reason, created_at,
+        resolved_at)
+    SELECT id, reporter, reported, channel, message_id, reason, created_at, resolved_at
+    FROM reports;
+DROP TABLE reports;
+ALTER TABLE reports_old RENAME TO reports;
+CREATE INDEX reports_resolved_at ON reports (resolved_at);
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"encoding/json"
+	"time"
+)
+
 // NOTE: These structs are mostly for the expected JSON format, not necessarily the
 // database schema.
 // 'omitempty' indicates not to use default values if omitted, e.g. do not use
@@ -19,9 +24,98 @@ type User struct {
 	Password   string `json:"password"` // sent unhashed
 }
 
+type CheckUserJSON struct {
+	Identifier string `json:"identifier"`
+	// proof we're allowed to know, if that is required: the identifier's
+	// password, or an invite for it. A session token also works.
+	Password string `json:"password"`
+	Invite   string `json:"invite"`
+}
+
+type ChangePasswordJSON struct {
+	Identifier  string `json:"identifier"`
+	Password    string `json:"password"` // the current one, verifies identifier
+	NewPassword string `json:"new_password"`
+}
+
+type RegisterKeyJSON struct {
+	Identifier string `json:"identifier"`
+	Password   string `json:"password"` // verifies identifier
+	Key        string `json:"key"`      // PEM encoded RSA public key
+}
+
+type ContactJSON struct {
+	Identifier string `json:"identifier"`
+	Password   string `json:"password"` // verifies identifier
+	Contact    string `json:"contact"`  // the other user
+}
+
+type BlockJSON struct {
+	Identifier string `json:"identifier"`
+	Password   string `json:"password"` // verifies identifier
+	Blocked    string `json:"blocked"`  // who to block or unblock
+}
+
+type ReportJSON struct {
+	Identifier string `json:"identifier"`
+	Password   string `json:"password"` // verifies identifier
+	Reported   string `json:"reported"` // who sent the message
+	Channel    string `json:"channel"`  // "message" or "nudge"
+	MessageID  int64  `json:"message_id"`
+	Reason     string `json:"reason"` // optional, what is wrong with it
+}
+
 type NewMessageJSON struct {
+	Identifier_from string          `json:"identifier_from"`
+	Password        string          `json:"password"` // verifies identifier_from
+	Identifier_to   string          `json:"identifier_to"`
+	Data            json.RawMessage `json:"data"` // as sent, since it may be signed
+
+	// optional, see signedMessage: base64 RSA signature by identifier_from's
+	// registered key, and when it was made in Unix seconds
+	Signature string `json:"signature"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type AckMessagesJSON struct {
+	Identifier string  `json:"identifier"`
+	Password   string  `json:"password"` // verifies identifier
+	IDs        []int64 `json:"ids"`      // messages to delete
+}
+
+// a pending message from one of the mailbox tables
+type Message struct {
+	ID              int64       `json:"id"`
 	Identifier_from string      `json:"identifier_from"`
-	Password        string      `json:"password"` // verifies identifier_from
-	Identifier_to   string      `json:"identifier_to"`
+	Channel         string      `json:"channel"`
+	CreatedAt       time.Time   `json:"created_at"`
+	ExpiresAt       *time.Time  `json:"expires_at,omitempty"` // nil if it never expires
 	Data            interface{} `json:"data"`
+	// set if the stored data isn't valid JSON, Data is then the raw string
+	Malformed bool `json:"malformed,omitempty"`
+}
+
+// what was erased when an account was deleted
+type DeletionReceipt struct {
+	Identifier string    `json:"identifier"`
+	DeletedAt  time.Time `json:"deleted_at"`
+	Messages   int64     `json:"messages"` // sent or received
+	Nudges     int64     `json:"nudges"`   // sent or received
+	Sessions   int64     `json:"sessions"`
+	Keys       int64     `json:"keys"` // public keys, current and replaced
+	Contacts   int64     `json:"contacts"`
+	Blocks     int64     `json:"blocks"` // made by the user
+}
+
+// a message or nudge a user reported, for moderators to review
+type Report struct {
+	ID         int64      `json:"id"`
+	Reporter   string     `json:"reporter"`
+	Reported   string     `json:"reported"`
+	Channel    string     `json:"channel"`
+	MessageID  int64      `json:"message_id"`
+	Data       string     `json:"data"` // the message's data when it was reported
+	Reason     string     `json:"reason"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"` // nil while open
 }
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// password hashing algorithms, as named in the config
+const (
+	algorithmBcrypt   = "bcrypt"
+	algorithmArgon2id = "argon2id"
+)
+
+// lengths of the Argon2id salt and key, in bytes
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// digests say how they were made, so different kinds can coexist: bcrypt ones
+// look like `$2a$10$...`, and Argon2id ones are in the PHC string format,
+// `$argon2id$v=19$m=19456,t=2,p=1$<salt>$<key>` with unpadded base64
+const argon2idPrefix = "$argon2id$"
+
+// hashes passwords with the configured algorithm and parameters, and checks
+// them against stored digests
+type passwordHasher struct {
+	cfg PasswordConfig
+
+	// made by hash on first use, see dummyDigest
+	dummy     []byte
+	dummyOnce sync.Once
+}
+
+func newPasswordHasher(cfg PasswordConfig) *passwordHasher {
+	return &passwordHasher{cfg: cfg}
+}
+
+// returns the digest to store for password
+func (h *passwordHasher) hash(password string) ([]byte, error) {
+	if h.cfg.Algorithm == algorithmArgon2id {
+		salt := make([]byte, argon2SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		return encodeArgon2id(h.argon2Params(), salt, password), nil
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), h.cfg.BcryptCost)
+}
+
+// returns true if digest wasn't made the way hash would make it now, e.g.
+// with an older algorithm or cost, so it should be replaced next time we see
+// the password
+func (h *passwordHasher) needsRehash(digest []byte) bool {
+	if h.cfg.Algorithm == algorithmArgon2id {
+		params, _, _, err := decodeArgon2id(digest)
+		return err != nil || params != h.argon2Params()
+	}
+	cost, err := bcrypt.Cost(digest)
+	return err != nil || cost != h.cfg.BcryptCost
+}
+
+// returns a digest made the current way, of no one's password. Comparing a
+// password to it takes as long as comparing to a real user's.
+func (h *passwordHasher) dummyDigest() []byte {
+	h.dummyOnce.Do(func() {
+		digest, err := h.hash("not anyone's password")
+		if err != nil {
+			// only if there is no randomness, which we can't run without anyway
+			panic(err)
+		}
+		h.dummy = digest
+	})
+	return h.dummy
+}
+
+// Argon2id cost parameters, as written in a digest
+type argon2Params struct {
+	memory      uint32 // KiB
+	iterations  uint32
+	parallelism uint8
+}
+
+func (h *passwordHasher) argon2Params() argon2Params {
+	return argon2Params{
+		memory:      uint32(h.cfg.Argon2MemoryKiB),
+		iterations:  uint32(h.cfg.Argon2Iterations),
+		parallelism: uint8(h.cfg.Argon2Parallelism),
+	}
+}
+
+// returns true if password matches digest, whichever way it was made. A wrong
+// password isn't an error, a malformed digest is.
+func compareDigest(digest []byte, password string) (bool, error) {
+	if strings.HasPrefix(string(digest), argon2idPrefix) {
+		params, salt, key, err := decodeArgon2id(digest)
+		if err != nil {
+			return false, err
+		}
+		attempt := argon2.IDKey([]byte(password), salt,
+			params.iterations, params.memory, params.parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(attempt, key) == 1, nil
+	}
+
+	err := bcrypt.CompareHashAndPassword(digest, []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func encodeArgon2id(params argon2Params, salt []byte, password string) []byte {
+	key := argon2.IDKey([]byte(password), salt,
+		params.iterations, params.memory, params.parallelism, argon2KeyLength)
+	return []byte(fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		params.memory, params.iterations, params.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)))
+}
+
+func decodeArgon2id(digest []byte) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	malformed := errors.New("malformed argon2id digest")
+
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(string(digest), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, malformed
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, malformed
+	} else if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d",
+		&params.memory, &params.iterations, &params.parallelism)
+	if err != nil {
+		return params, nil, nil, malformed
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, malformed
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, malformed
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestNeedsRehash(t *testing.T) {
+	hasher := newPasswordHasher(PasswordConfig{BcryptCost: bcrypt.MinCost + 1})
+	old, _ := bcrypt.GenerateFromPassword([]byte("battery horse staple"), bcrypt.MinCost)
+	current, _ := hasher.hash("battery horse staple")
+
+	assert.True(t, hasher.needsRehash(old))
+	assert.False(t, hasher.needsRehash(current))
+}
+
+func TestRehashOnLogin(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+	old, _ := bcrypt.GenerateFromPassword([]byte("battery horse staple"), bcrypt.MinCost)
+	assert.NoError(t, db.InsertUser(ctx, "user", old))
+
+	hasher := newPasswordHasher(PasswordConfig{BcryptCost: bcrypt.MinCost + 1})
+	sm := newSessionManager(db, []byte("test secret"), time.Hour, LockoutConfig{}, hasher)
+
+	// a wrong password doesn't touch the digest
+	valid, err := sm.checkPassword(ctx, "203.0.113.7", "user", "wrong")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+	stored, _ := db.GetPasswordDigest(ctx, "user")
+	assert.Equal(t, old, stored)
+
+	valid, err = sm.checkPassword(ctx, "203.0.113.7", "user", "battery horse staple")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	stored, _ = db.GetPasswordDigest(ctx, "user")
+	cost, _ := bcrypt.Cost(stored)
+	assert.Equal(t, bcrypt.MinCost+1, cost)
+
+	// and the new digest still works
+	valid, _ = compareDigest(stored, "battery horse staple")
+	assert.True(t, valid)
+}
+
+// cheap enough for tests
+var testArgon2Config = PasswordConfig{Algorithm: algorithmArgon2id,
+	Argon2MemoryKiB: 64, Argon2Iterations: 1, Argon2Parallelism: 1}
+
+func TestArgon2idDigest(t *testing.T) {
+	hasher := newPasswordHasher(testArgon2Config)
+	digest, err := hasher.hash("battery horse staple")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Regexp(t, `^\$argon2id\$v=19\$m=64,t=1,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`,
+		string(digest))
+
+	valid, err := compareDigest(digest, "battery horse staple")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	valid, err = compareDigest(digest, "wrong")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	assert.False(t, hasher.needsRehash(digest))
+	stronger := testArgon2Config
+	stronger.Argon2Iterations = 2
+	assert.True(t, newPasswordHasher(stronger).needsRehash(digest))
+
+	_, err = compareDigest([]byte("$argon2id$v=19$m=64,t=1,p=1$bad"), "battery horse staple")
+	assert.Error(t, err)
+}
+
+func TestMigrateBcryptToArgon2idOnLogin(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+	old, _ := bcrypt.GenerateFromPassword([]byte("battery horse staple"), bcrypt.MinCost)
+	assert.NoError(t, db.InsertUser(ctx, "user", old))
+
+	sm := newSessionManager(db, []byte("test secret"), time.Hour, LockoutConfig{},
+		newPasswordHasher(testArgon2Config))
+	valid, err := sm.checkPassword(ctx, "203.0.113.7", "user", "battery horse staple")
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	stored, _ := db.GetPasswordDigest(ctx, "user")
+	assert.True(t, strings.HasPrefix(string(stored), argon2idPrefix))
+	valid, _ = sm.checkPassword(ctx, "203.0.113.7", "user", "battery horse staple")
+	assert.True(t, valid)
+}
+
+func TestDummyDigestMatchesConfig(t *testing.T) {
+	hasher := newPasswordHasher(testArgon2Config)
+	assert.False(t, hasher.needsRehash(hasher.dummyDigest()))
+
+	valid, err := compareDigest(hasher.dummyDigest(), "battery horse staple")
+	assert.NoError(t, err)
+	assert.False(t, valid)
+}
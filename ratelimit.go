@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// a token bucket budget: up to Requests at once, refilling at Requests every
+// Per. Written like "5/1h"; the zero value disables limiting.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (r RateLimit) enabled() bool {
+	return r.Requests > 0
+}
+
+func (r *RateLimit) Set(value string) error {
+	if value == "" || value == "0" {
+		*r = RateLimit{}
+		return nil
+	}
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("rate limit %q should look like 5/1h", value)
+	}
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests < 0 {
+		return fmt.Errorf("invalid number of requests in rate limit %q", value)
+	}
+	per, err := time.ParseDuration(parts[1])
+	if err != nil || per <= 0 {
+		return fmt.Errorf("invalid period in rate limit %q", value)
+	}
+	*r = RateLimit{Requests: requests, Per: per}
+	return nil
+}
+
+func (r *RateLimit) String() string {
+	if r == nil || !r.enabled() {
+		return "0"
+	}
+	return strconv.Itoa(r.Requests) + "/" + r.Per.String()
+}
+
+func (r RateLimit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *RateLimit) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return r.Set(value)
+}
+
+// keeps the token buckets. Only the in-memory one exists, which is fine while
+// we run a single instance; more would need a shared one, e.g. in Redis.
+type RateLimitBackend interface {
+	// takes a token from each of the keys' buckets, if they all have one.
+	// Otherwise takes none, and returns false and how long until they will.
+	Take(keys []string, limit RateLimit, now time.Time) (bool, time.Duration)
+}
+
+// how often idle buckets are dropped from memory
+const rateLimitSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+
+	// when the bucket will be full again, after which it can be forgotten
+	full time.Time
+}
+
+type memoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+func (m *memoryRateLimiter) Take(keys []string, limit RateLimit, now time.Time) (bool, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(now)
+
+	capacity := float64(limit.Requests)
+	perSecond := capacity / limit.Per.Seconds()
+	buckets := make([]*tokenBucket, len(keys))
+	lowest := capacity
+	for i, key := range keys {
+		bucket, ok := m.buckets[key]
+		if !ok {
+			bucket = &tokenBucket{tokens: capacity, updated: now}
+			m.buckets[key] = bucket
+		}
+		refilled := now.Sub(bucket.updated).Seconds() * perSecond
+		bucket.tokens = math.Min(capacity, bucket.tokens+refilled)
+		bucket.updated = now
+		bucket.full = now.Add(secondsDuration((capacity - bucket.tokens) / perSecond))
+
+		buckets[i] = bucket
+		lowest = math.Min(lowest, bucket.tokens)
+	}
+	if lowest < 1 {
+		return false, secondsDuration((1 - lowest) / perSecond)
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens--
+		bucket.full = now.Add(secondsDuration((capacity - bucket.tokens) / perSecond))
+	}
+	return true, 0
+}
+
+// drops the buckets that have refilled, since a new one would be the same
+func (m *memoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	m.lastSweep = now
+	for key, bucket := range m.buckets {
+		if !now.Before(bucket.full) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// middleware limiting requests to limit per client, with a separate budget
+// for each group of routes. Clients are identified by IP address, and once
+// they have authenticated, by identifier; see limitClient. Anyone can claim
+// an identifier, so it isn't charged for before it's proven.
+func rateLimit(backend RateLimitBackend, group string, limit RateLimit) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if !limit.enabled() {
+			return next
+		}
+		return func(c echo.Context) error {
+			if err := takeToken(backend, group, limit, group+":ip:"+c.RealIP()); err != nil {
+				return err
+			}
+			c.Set(rateLimitClientKey, func(identifier string) error {
+				return takeToken(backend, group, limit, group+":id:"+identifier)
+			})
+			return next(c)
+		}
+	}
+}
+
+// where rateLimit keeps the charge for an authenticated client in the
+// request context
+const rateLimitClientKey = "rateLimitClient"
+
+// charges identifier, whom the request has been authenticated as, against
+// the rate limit of its route, if it has one
+func limitClient(c echo.Context, identifier string) error {
+	if charge, ok := c.Get(rateLimitClientKey).(func(string) error); ok {
+		return charge(identifier)
+	}
+	return nil
+}
+
+// takes a token from key's bucket, or returns a rate_limited APIError
+func takeToken(backend RateLimitBackend, group string, limit RateLimit, key string) error {
+	if allowed, retryAfter := backend.Take([]string{key}, limit, time.Now()); !allowed {
+		rateLimitedRequests.WithLabelValues(group).Inc()
+		return &APIError{Code: codeRateLimited,
+			Reason: "Too many requests, please try again later.", retryAfter: retryAfter}
+	}
+	return nil
+}
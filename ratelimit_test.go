@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucketRefills(t *testing.T) {
+	limiter := newMemoryRateLimiter()
+	limit := RateLimit{Requests: 2, Per: time.Minute}
+	now := time.Now()
+
+	allowed, _ := limiter.Take([]string{"a"}, limit, now)
+	assert.True(t, allowed)
+	allowed, _ = limiter.Take([]string{"a"}, limit, now)
+	assert.True(t, allowed)
+	allowed, retryAfter := limiter.Take([]string{"a"}, limit, now)
+	assert.False(t, allowed)
+	assert.Equal(t, 30*time.Second, retryAfter.Round(time.Second))
+
+	// other keys have their own bucket
+	allowed, _ = limiter.Take([]string{"b"}, limit, now)
+	assert.True(t, allowed)
+
+	allowed, _ = limiter.Take([]string{"a"}, limit, now.Add(30*time.Second))
+	assert.True(t, allowed)
+	allowed, _ = limiter.Take([]string{"a"}, limit, now.Add(30*time.Second))
+	assert.False(t, allowed)
+
+	// nothing is taken from b when a is empty
+	allowed, _ = limiter.Take([]string{"a", "b"}, limit, now.Add(30*time.Second))
+	assert.False(t, allowed)
+	allowed, _ = limiter.Take([]string{"b"}, limit, now.Add(30*time.Second))
+	assert.True(t, allowed)
+}
+
+func TestTokenBucketSweep(t *testing.T) {
+	limiter := newMemoryRateLimiter()
+	limit := RateLimit{Requests: 2, Per: time.Minute}
+	now := time.Now()
+
+	limiter.Take([]string{"a"}, limit, now)
+	limiter.Take([]string{"b"}, limit, now.Add(2*time.Minute))
+	assert.Len(t, limiter.buckets, 1, "a had refilled")
+}
+
+func TestRateLimitSet(t *testing.T) {
+	var limit RateLimit
+	assert.NoError(t, limit.Set("5/1h"))
+	assert.Equal(t, RateLimit{Requests: 5, Per: time.Hour}, limit)
+	assert.Equal(t, "5/1h0m0s", limit.String())
+
+	assert.NoError(t, limit.Set("0"))
+	assert.False(t, limit.enabled())
+
+	assert.Error(t, limit.Set("5"))
+	assert.Error(t, limit.Set("x/1h"))
+	assert.Error(t, limit.Set("5/0s"))
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = handleHTTPError
+	limiter := newMemoryRateLimiter()
+	limit := RateLimit{Requests: 1, Per: time.Hour}
+	e.POST("/user/new", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, rateLimit(limiter, "signup", limit))
+	// stands in for a handler calling sm.authenticate
+	e.POST("/user/message/new", func(c echo.Context) error {
+		var body struct {
+			Identifier string `json:"identifier"`
+			Password   string `json:"password"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		if body.Password != "right" {
+			return errBadPassword
+		}
+		if err := limitClient(c, body.Identifier); err != nil {
+			return err
+		}
+		return c.NoContent(http.StatusOK)
+	}, rateLimit(limiter, "message", limit))
+
+	post := func(path string, ip string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("/user/new", "203.0.113.7", `{"identifier":"user"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = post("/user/new", "203.0.113.7", `{"identifier":"other"}`)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "3600", rec.Header().Get("Retry-After"))
+	assert.Contains(t, rec.Body.String(), `"code":"rate_limited"`)
+
+	// claiming to be someone doesn't use up their budget
+	rec = post("/user/message/new", "203.0.113.8", `{"identifier":"user","password":"wrong"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = post("/user/message/new", "203.0.113.9", `{"identifier":"user","password":"right"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// but once they have authenticated, a new address doesn't help
+	rec = post("/user/message/new", "198.51.100.4", `{"identifier":"user","password":"right"}`)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	rec = post("/user/message/new", "198.51.100.5", `{"identifier":"other","password":"right"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
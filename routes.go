@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"html/template"
@@ -32,21 +33,40 @@ type MapTemplate struct {
 type SafeMapTemplate struct {
 	mu   sync.Mutex
 	mapT MapTemplate
+
+	lastRefresh   time.Time // when mapT was last successfully updated
+	lastErr       error     // the last error updating it, if any
+	lastErrorTime time.Time
 }
 
 const messageTableName = "unread_messages"
 const nudgeTableName = "user_nudge"
 
+// name of the channel each mailbox table holds, as seen by clients
+var channelNames = map[string]string{
+	messageTableName: "message",
+	nudgeTableName:   "nudge",
+}
+
 // NOTE: map demo has fixed data
 var mapDemoTemplate MapTemplate = MapTemplate{}
 
 var mapTemplate SafeMapTemplate = SafeMapTemplate{}
 
 // registers the routes and handlers
-func setupRoutes(e *echo.Echo, db *sql.DB, mydb DataSource) {
-	initTemplateCache(db)
+func setupRoutes(e *echo.Echo, cfg *Config, dbs *databases, sm *SessionManager) {
+	db, mydb := dbs.main, dbs.mydb
+	limiter := newMemoryRateLimiter()
+	limits := cfg.RateLimits
+	rules := messageRules{
+		requireSignature: cfg.RequireSignedMessages,
+		requireContacts:  cfg.RequireContacts,
+	}
 
 	e.GET("/", index)
+	e.GET("/healthz", handleHealthz)
+	e.GET("/metrics", handleMetrics(newMetricsRegistry(mydb)))
+	e.GET("/readyz", handleReadyz(db, cfg.TemplateRefresh.Duration))
 	e.GET("/map", func(c echo.Context) error {
 		mapTemplate.mu.Lock()
 		mapT := mapTemplate.mapT
@@ -72,48 +92,109 @@ func setupRoutes(e *echo.Echo, db *sql.DB, mydb DataSource) {
 			return err
 		}
 
-		err := insertWellbeingRecord(*record, db)
+		ctx, cancel := context.WithTimeout(c.Request().Context(), cfg.Database.QueryTimeout.Duration)
+		defer cancel()
+		err := insertWellbeingRecord(ctx, *record, db)
 		if err != nil {
 			log.Print(err)
 			return err
 		}
+		wellbeingRecordsInserted.Inc()
 		return c.JSON(http.StatusOK, map[string]bool{"success": true})
-	})
+	}, rateLimit(limiter, "wellbeing", limits.Wellbeing))
 
 	// wellbeing sharing
 	e.GET("/add-friend", handleAddFriend)
-	e.POST("/user", handleCheckUser(mydb))
-	e.POST("/user/new", handleAddUser(mydb))
-	e.POST("/user/message", handleGetMessage(mydb, messageTableName))
-	e.POST("/user/message/new", handleNewMessage(mydb, messageTableName, true))
+	e.POST("/user", handleCheckUser(mydb, sm, cfg.RequireLookupProof))
+	e.POST("/user/new", handleAddUser(mydb, sm.hasher, cfg.RequireLookupProof), rateLimit(limiter, "signup", limits.Signup))
+	e.DELETE("/user", handleDeleteUser(mydb, sm))
+	e.POST("/user/login", handleLogin(sm))
+	e.POST("/user/invite", handleInvite(sm))
+	e.POST("/user/password", handleChangePassword(mydb, sm))
+	e.POST("/user/key", handleRegisterKey(mydb, sm))
+	e.GET("/user/key", handleGetKey(mydb, sm, cfg.RequireLookupProof))
+	e.GET("/user/key/history", handleKeyHistory(mydb, sm, cfg.RequireLookupProof))
+	e.POST("/user/session/refresh", handleRefreshSession(sm))
+	e.POST("/user/logout", handleLogout(sm))
+	e.POST("/user/message", handleGetMessage(mydb, sm, messageTableName))
+	e.POST("/user/message/fetch", handleFetchMessages(mydb, sm, messageTableName))
+	e.POST("/user/message/ack", handleAckMessages(mydb, sm, messageTableName))
+	e.POST("/user/contacts", handleListContacts(mydb, sm))
+	e.POST("/user/contacts/request", handleContactRequest(mydb, sm),
+		rateLimit(limiter, "message", limits.Message))
+	e.POST("/user/contacts/accept", handleContactAccept(mydb, sm))
+	e.POST("/user/contacts/decline", handleContactDecline(mydb, sm))
+	e.POST("/user/contacts/remove", handleContactRemove(mydb, sm))
+	e.POST("/user/block", handleBlock(mydb, sm))
+	e.POST("/user/unblock", handleUnblock(mydb, sm))
+	e.POST("/user/report", handleReport(mydb, sm), rateLimit(limiter, "message", limits.Message))
+	e.POST("/user/message/new", handleNewMessage(mydb, sm, messageTableName, true,
+		cfg.MessageTTL.Message.Duration, rules),
+		rateLimit(limiter, "message", limits.Message))
 
 	// p2p nudge:
 	// the back-end logic of passing around 'messages' is essentially the same,
 	// it's up to the clients to define and handle the 'message' format.
 	// Only difference is we don't overwrite pending messages.
-	e.POST("/user/nudge", handleGetMessage(mydb, nudgeTableName))
-	e.POST("/user/nudge/new", handleNewMessage(mydb, nudgeTableName, false))
+	e.POST("/user/nudge", handleGetMessage(mydb, sm, nudgeTableName))
+	e.POST("/user/nudge/fetch", handleFetchMessages(mydb, sm, nudgeTableName))
+	e.POST("/user/nudge/ack", handleAckMessages(mydb, sm, nudgeTableName))
+	e.POST("/user/nudge/new", handleNewMessage(mydb, sm, nudgeTableName, false,
+		cfg.MessageTTL.Nudge.Duration, rules),
+		rateLimit(limiter, "message", limits.Message))
 }
 
-func initTemplateCache(mainDb *sql.DB) {
-	mockDb := getDBConn("newdatabase")
-	defer mockDb.Close()
-	mapDemoTemplate = *getMapTemplate(mockDb, true)
+// computes the map demo data, and starts a goroutine refreshing the map data
+// every `refresh` until ctx is cancelled. wg is done once it has stopped.
+// Each computation may take up to queryTimeout.
+func initTemplateCache(ctx context.Context, wg *sync.WaitGroup,
+	mainDb *sql.DB, mockDb *sql.DB, refresh time.Duration, queryTimeout time.Duration) {
+	demoCtx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	if mapT, err := getMapTemplate(demoCtx, mockDb, true); err != nil {
+		log.Print(err)
+	} else {
+		mapDemoTemplate = *mapT
+	}
 
-	twoMinutes := time.Duration(2) * time.Minute
-	go updateTemplateCache(mainDb, twoMinutes)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		updateTemplateCache(ctx, mainDb, refresh, queryTimeout)
+	}()
 }
 
-// updates safeMapTemplate every `duration`
-func updateTemplateCache(db *sql.DB, duration time.Duration) {
-	mapT := getMapTemplate(db, false)
+// updates safeMapTemplate every `duration` until ctx is cancelled
+func updateTemplateCache(ctx context.Context, db *sql.DB,
+	duration time.Duration, queryTimeout time.Duration) {
+	ticker := time.NewTicker(duration)
+	defer ticker.Stop()
 
-	mapTemplate.mu.Lock()
-	mapTemplate.mapT = *mapT
-	mapTemplate.mu.Unlock()
+	for {
+		// keep serving the last good data if this fails
+		start := time.Now()
+		refreshCtx, cancel := context.WithTimeout(ctx, queryTimeout)
+		mapT, err := getMapTemplate(refreshCtx, db, false)
+		cancel()
+		mapRefreshDuration.Observe(time.Since(start).Seconds())
+		mapTemplate.mu.Lock()
+		if err != nil {
+			log.Print(err)
+			mapRefreshErrors.Inc()
+			mapTemplate.lastErr = err
+			mapTemplate.lastErrorTime = time.Now()
+		} else {
+			mapTemplate.mapT = *mapT
+			mapTemplate.lastRefresh = time.Now()
+		}
+		mapTemplate.mu.Unlock()
 
-	time.Sleep(duration)
-	updateTemplateCache(db, duration)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
 func index(c echo.Context) error {
@@ -122,11 +203,11 @@ func index(c echo.Context) error {
 }
 
 // inserts (a copy of) wellbeing record into the database
-func insertWellbeingRecord(record WellbeingRecord, db *sql.DB) error {
+func insertWellbeingRecord(ctx context.Context, record WellbeingRecord, db *sql.DB) error {
 	query := `INSERT INTO scores` +
 		` (postCode, wellbeingScore, weeklySteps, errorRate, supportCode, date_sent)` +
 		` VALUES (?, ?, ?, ?, ?, ?)`
-	_, err := db.Exec(query,
+	_, err := db.ExecContext(ctx, query,
 		record.PostCode,
 		record.WellbeingScore,
 		record.WeeklySteps,
@@ -136,7 +217,7 @@ func insertWellbeingRecord(record WellbeingRecord, db *sql.DB) error {
 	return err
 }
 
-func getMapTemplate(db *sql.DB, isMock bool) *MapTemplate {
+func getMapTemplate(ctx context.Context, db *sql.DB, isMock bool) (*MapTemplate, error) {
 	// column names are case insensitive
 	var tableName string
 	if isMock {
@@ -149,9 +230,9 @@ func getMapTemplate(db *sql.DB, isMock bool) *MapTemplate {
 	suppcodeGroupQuery := "SELECT Postcode as name, SupportCode as supportcode, " +
 		"AVG(WellBeingScore)as score, COUNT(SupportCode) as entries FROM " +
 		tableName + " GROUP BY SupportCode, PostCode;"
-	rows, err := db.Query(postcodeGroupQuery)
+	rows, err := db.QueryContext(ctx, postcodeGroupQuery)
 	if err != nil {
-		log.Print(err)
+		return nil, err
 	}
 	defer rows.Close()
 	overlayDataMapDemo := make([]map[string]interface{}, 0)
@@ -160,18 +241,18 @@ func getMapTemplate(db *sql.DB, isMock bool) *MapTemplate {
 		var avgscore float32
 		var quantity int
 		if err := rows.Scan(&name, &avgscore, &quantity); err != nil {
-			log.Print(err)
+			return nil, err
 		}
 		data := map[string]interface{}{"name": name, "avgscore": avgscore, "quantity": quantity}
 		overlayDataMapDemo = append(overlayDataMapDemo, data)
 	}
 	if err := rows.Err(); err != nil {
-		log.Print(err)
+		return nil, err
 	}
 
-	rows2, err := db.Query(suppcodeGroupQuery)
+	rows2, err := db.QueryContext(ctx, suppcodeGroupQuery)
 	if err != nil {
-		log.Print(err)
+		return nil, err
 	}
 	defer rows2.Close()
 	informationMap := make([]map[string]interface{}, 0)
@@ -181,22 +262,23 @@ func getMapTemplate(db *sql.DB, isMock bool) *MapTemplate {
 		var score float32
 		var entries int
 		if err := rows2.Scan(&name, &supportCode, &score, &entries); err != nil {
-			log.Print(err)
+			return nil, err
 		}
 		data := map[string]interface{}{"name": name,
 			"supportcode": supportCode, "score": score, "entries": entries}
 		informationMap = append(informationMap, data)
 	}
+	if err := rows2.Err(); err != nil {
+		return nil, err
+	}
 
 	mapcodeData, err := json.Marshal(overlayDataMapDemo)
-	supcodeData, err2 := json.Marshal(informationMap)
 	if err != nil {
-		log.Print(err)
-		return nil
+		return nil, err
 	}
-	if err2 != nil {
-		log.Print(err2)
-		return nil
+	supcodeData, err := json.Marshal(informationMap)
+	if err != nil {
+		return nil, err
 	}
-	return &MapTemplate{string(mapcodeData), string(supcodeData)}
+	return &MapTemplate{string(mapcodeData), string(supcodeData)}, nil
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTemplateCacheStopsOnCancel(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	initTemplateCache(ctx, &wg, db.database, db.database, time.Millisecond, time.Second)
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("template cache refresher didn't stop")
+	}
+}
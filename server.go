@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ways of serving, see TLSConfig.Mode
+const (
+	listenAutocert   = "autocert"
+	listenStatic     = "static"
+	listenSelfSigned = "selfsigned"
+	listenHTTP       = "http"
+)
+
+// sets up how client IPs are found, which depends on whether we are behind a
+// proxy
+func setupIPExtractor(e *echo.Echo, cfg TLSConfig) error {
+	if cfg.Mode != listenHTTP || len(cfg.TrustedProxies) == 0 {
+		// nothing in front of us, so the headers can't be trusted
+		e.IPExtractor = echo.ExtractIPDirect()
+		return nil
+	}
+
+	// only the configured proxies, not every private address as echo would
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range cfg.TrustedProxies {
+		ipRange, err := parseIPRange(proxy)
+		if err != nil {
+			return err
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	e.IPExtractor = echo.ExtractIPFromXFFHeader(options...)
+	return nil
+}
+
+// serves in the configured mode, blocking until the server stops
+func startServer(e *echo.Echo, cfg *Config) error {
+	switch cfg.TLS.Mode {
+	case listenAutocert:
+		// NOTE: since we are using HTTPS through Auto TLS, we have to use a
+		// domain name for the server to work
+		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(cfg.Domain)
+		e.AutoTLSManager.Cache = autocert.DirCache(cfg.Cache.AutocertDir)
+		return e.StartAutoTLS(cfg.Listen)
+	case listenStatic:
+		return e.StartTLS(cfg.Listen, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	case listenSelfSigned:
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		if cfg.Domain != "" {
+			hosts = append(hosts, cfg.Domain)
+		}
+		certPEM, keyPEM, err := selfSignedCert(hosts, time.Now())
+		if err != nil {
+			return err
+		}
+		log.Print("serving with a self-signed certificate, clients will need to skip verification")
+		return e.StartTLS(cfg.Listen, certPEM, keyPEM)
+	case listenHTTP:
+		return e.Start(cfg.Listen)
+	default:
+		return fmt.Errorf("unknown listen mode %q", cfg.TLS.Mode)
+	}
+}
+
+// generates a certificate and key, PEM encoded, valid for hosts for a year
+func selfSignedCert(hosts []string, now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"NudgeMe development"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// parses a CIDR range, or a single IP address
+func parseIPRange(value string) (*net.IPNet, error) {
+	if ip := net.ParseIP(value); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipRange, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy address %q", value)
+	}
+	return ipRange, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelfSignedCert(t *testing.T) {
+	certPEM, keyPEM, err := selfSignedCert([]string{"localhost", "127.0.0.1"}, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if assert.NoError(t, err) {
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if assert.NoError(t, err) {
+			assert.NoError(t, cert.VerifyHostname("localhost"))
+			assert.NoError(t, cert.VerifyHostname("127.0.0.1"))
+			assert.Error(t, cert.VerifyHostname("example.com"))
+		}
+	}
+}
+
+func TestIPExtractorTrustsOnlyConfiguredProxies(t *testing.T) {
+	e := echo.New()
+	err := setupIPExtractor(e, TLSConfig{Mode: listenHTTP, TrustedProxies: []string{"10.0.0.1"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	fromProxy := httptest.NewRequest(http.MethodGet, "/", nil)
+	fromProxy.RemoteAddr = "10.0.0.1:1234"
+	fromProxy.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+	assert.Equal(t, "203.0.113.7", e.IPExtractor(fromProxy))
+
+	// another private address isn't trusted just for being private
+	spoofed := httptest.NewRequest(http.MethodGet, "/", nil)
+	spoofed.RemoteAddr = "10.0.0.2:1234"
+	spoofed.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+	assert.Equal(t, "10.0.0.2", e.IPExtractor(spoofed))
+}
+
+func TestIPExtractorIgnoresHeadersWithoutProxy(t *testing.T) {
+	e := echo.New()
+	assert.NoError(t, setupIPExtractor(e, TLSConfig{Mode: listenAutocert}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "198.51.100.4:1234"
+	req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+	assert.Equal(t, "198.51.100.4", e.IPExtractor(req))
+}
+
+func TestConfigValidateListenModes(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.TLS.Mode = listenStatic
+	assert.Error(t, cfg.Validate())
+	cfg.TLS.CertFile, cfg.TLS.KeyFile = "cert.pem", "key.pem"
+	assert.NoError(t, cfg.Validate())
+
+	// no domain needed outside autocert
+	cfg.TLS.Mode = listenHTTP
+	cfg.TLS.TrustedProxies = []string{"127.0.0.1", "10.0.0.0/8"}
+	assert.NoError(t, cfg.Validate())
+	cfg.TLS.TrustedProxies = []string{"not an address"}
+	assert.Error(t, cfg.Validate())
+}
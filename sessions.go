@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// how long a session token is valid for before it has to be refreshed
+const sessionTTL = 7 * 24 * time.Hour
+
+// how long an invite to check that a user exists is valid for
+const inviteTTL = 30 * 24 * time.Hour
+
+// a login session, as stored in the database
+type Session struct {
+	ID         string
+	Identifier string
+	ExpiresAt  time.Time
+}
+
+// issues and checks session tokens, so clients don't have to send their
+// password on every request.
+//
+// A token looks like `<session id>.<expiry>.<signature>`; the signature lets
+// us reject forged or expired tokens without a database lookup, and the
+// session row lets us revoke tokens.
+type SessionManager struct {
+	db     DataSource
+	secret []byte
+	ttl    time.Duration
+
+	// slows down password guessing, see lockout.go
+	lockout LockoutConfig
+
+	// upgrades old password digests as they are checked
+	hasher *passwordHasher
+}
+
+func newSessionManager(db DataSource, secret []byte, ttl time.Duration,
+	lockout LockoutConfig, hasher *passwordHasher) *SessionManager {
+	return &SessionManager{db: db, secret: secret, ttl: ttl, lockout: lockout, hasher: hasher}
+}
+
+// creates a new session for identifier and returns its token
+func (sm *SessionManager) Issue(ctx context.Context, identifier string) (string, time.Time, error) {
+	id := make([]byte, 24)
+	if _, err := rand.Read(id); err != nil {
+		return "", time.Time{}, err
+	}
+
+	session := Session{
+		ID:         base64.RawURLEncoding.EncodeToString(id),
+		Identifier: identifier,
+		ExpiresAt:  time.Now().Add(sm.ttl).UTC().Truncate(time.Second),
+	}
+	if err := sm.db.InsertSession(ctx, session); err != nil {
+		return "", time.Time{}, err
+	}
+
+	payload := session.ID + "." + strconv.FormatInt(session.ExpiresAt.Unix(), 10)
+	return payload + "." + sm.sign(payload), session.ExpiresAt, nil
+}
+
+// returns the session the token belongs to, or nil if the token is forged,
+// expired or revoked
+func (sm *SessionManager) Verify(ctx context.Context, token string) (*Session, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(sm.sign(payload)), []byte(parts[2])) {
+		return nil, nil
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= expiry {
+		return nil, nil
+	}
+
+	session, err := sm.db.GetSession(ctx, parts[0])
+	if err != nil || session == nil {
+		return nil, err
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, nil
+	}
+	return session, nil
+}
+
+// replaces the session behind token with a new one, returning the new token.
+// Returns an empty token if the old one isn't valid.
+func (sm *SessionManager) Refresh(ctx context.Context, token string) (string, time.Time, error) {
+	session, err := sm.Verify(ctx, token)
+	if err != nil || session == nil {
+		return "", time.Time{}, err
+	}
+
+	if err := sm.db.DeleteSession(ctx, session.ID); err != nil {
+		return "", time.Time{}, err
+	}
+	return sm.Issue(ctx, session.Identifier)
+}
+
+// revokes the session behind token. Returns false if the token isn't valid.
+func (sm *SessionManager) Revoke(ctx context.Context, token string) (bool, error) {
+	session, err := sm.Verify(ctx, token)
+	if err != nil || session == nil {
+		return false, err
+	}
+	return true, sm.db.DeleteSession(ctx, session.ID)
+}
+
+// returns an invite that proves whoever has it was given it by identifier.
+// Unlike sessions, invites aren't stored, so can't be revoked.
+func (sm *SessionManager) IssueInvite(identifier string) (string, time.Time) {
+	expiresAt := time.Now().Add(inviteTTL).UTC().Truncate(time.Second)
+	expiry := strconv.FormatInt(expiresAt.Unix(), 10)
+	return expiry + "." + sm.sign("invite."+identifier+"."+expiry), expiresAt
+}
+
+// returns true if invite was issued for identifier and hasn't expired
+func (sm *SessionManager) VerifyInvite(invite string, identifier string) bool {
+	parts := strings.Split(invite, ".")
+	if len(parts) != 2 {
+		return false
+	}
+	signature := sm.sign("invite." + identifier + "." + parts[0])
+	if !hmac.Equal([]byte(signature), []byte(parts[1])) {
+		return false
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	return err == nil && time.Now().Unix() < expiry
+}
+
+// works out who is making the request. Uses the session token in the
+// Authorization header if there is one, otherwise falls back to the
+// identifier and password from the body, which older app builds send.
+//
+// Returns an empty identifier if the credentials don't check out. Once they
+// do, the identifier is charged against the route's rate limit.
+func (sm *SessionManager) authenticate(c echo.Context,
+	identifier string, password string) (string, error) {
+	ctx := c.Request().Context()
+	if token, ok := bearerToken(c); ok {
+		session, err := sm.Verify(ctx, token)
+		if err != nil || session == nil {
+			return "", err
+		}
+		identifier = session.Identifier
+	} else {
+		valid, err := sm.checkPassword(ctx, c.RealIP(), identifier, password)
+		if err != nil || !valid {
+			return "", err
+		}
+	}
+
+	if err := limitClient(c, identifier); err != nil {
+		return "", err
+	}
+	return identifier, nil
+}
+
+// returns true if password is the one stored for identifier. ip is where
+// the attempt came from.
+//
+// Failures are counted per identifier and per IP; once either has failed too
+// often, checks are refused with a locked_out error without looking at the
+// password. Each check is counted before the password is compared, and taken
+// back if it was right. A correct password stored with an older cost is
+// rehashed.
+func (sm *SessionManager) checkPassword(ctx context.Context,
+	ip string, identifier string, password string) (bool, error) {
+	attempts, err := sm.reserveAttempt(ctx, sm.lockKeys(ip, identifier))
+	if err != nil {
+		return false, err
+	}
+
+	start := time.Now()
+	digest, err := sm.db.GetPasswordDigest(ctx, identifier)
+	valid := false
+	if err == nil && digest != nil {
+		valid, err = compareDigest(digest, password)
+	} else if err == nil {
+		// take as long as for a real user, so the timing doesn't give away
+		// which identifiers exist
+		compareDigest(sm.hasher.dummyDigest(), password)
+	}
+	passwordCheckDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		passwordCheckFailures.Inc()
+		// the password wasn't checked, so it isn't a failure
+		if releaseErr := sm.releaseAttempts(ctx, attempts); releaseErr != nil {
+			log.Print(releaseErr)
+		}
+		return false, err
+	} else if !valid {
+		passwordCheckFailures.Inc()
+		logLockouts(attempts)
+		return false, nil
+	}
+
+	// the identifier's failures are forgotten, but the IP's other failures
+	// stand, or one account of their own would let someone reset them
+	if sm.lockout.IdentifierThreshold > 0 {
+		if _, err := sm.db.ClearLockout(ctx, "id:"+identifier); err != nil {
+			return false, err
+		}
+	}
+	var ipAttempts []lockAttempt
+	for _, attempt := range attempts {
+		if attempt.key.key != "id:"+identifier {
+			ipAttempts = append(ipAttempts, attempt)
+		}
+	}
+	if err := sm.releaseAttempts(ctx, ipAttempts); err != nil {
+		return false, err
+	}
+
+	if sm.hasher.needsRehash(digest) {
+		// the password was right either way, so this isn't worth failing for
+		if err := sm.rehash(ctx, identifier, password); err != nil {
+			log.Printf("couldn't rehash password: %v", err)
+		}
+	}
+	return true, nil
+}
+
+// stores a new digest of password, made the current way
+func (sm *SessionManager) rehash(ctx context.Context, identifier string, password string) error {
+	digest, err := sm.hasher.hash(password)
+	if err != nil {
+		return err
+	}
+	return sm.db.UpdatePassword(ctx, identifier, digest)
+}
+
+func (sm *SessionManager) sign(payload string) string {
+	mac := hmac.New(sha256.New, sm.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// returns the token from an `Authorization: Bearer <token>` header
+func bearerToken(c echo.Context) (string, bool) {
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return header[len(prefix):], true
+}
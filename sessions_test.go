@@ -0,0 +1,25 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvites(t *testing.T) {
+	sm := newTestSessionManager(nil)
+	invite, expiresAt := sm.IssueInvite("user")
+	assert.WithinDuration(t, time.Now().Add(inviteTTL), expiresAt, time.Minute)
+
+	assert.True(t, sm.VerifyInvite(invite, "user"))
+	assert.False(t, sm.VerifyInvite(invite, "other"))
+	assert.False(t, sm.VerifyInvite(invite+"x", "user"))
+	assert.False(t, newSessionManager(nil, []byte("other secret"), time.Hour,
+		LockoutConfig{}, nil).VerifyInvite(invite, "user"))
+
+	expiry := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	expired := expiry + "." + sm.sign("invite.user."+expiry)
+	assert.False(t, sm.VerifyInvite(expired, "user"))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"database/sql"
+
+	// needed but not directly used
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// DataSource backed by an SQLite file, so the server can run without the
+// MySQL database, e.g. for local development and tests.
+//
+// The queries MyDB uses work as they are on SQLite, so it only overrides
+// what differs.
+type SQLiteDB struct {
+	MyDB
+}
+
+// opens (creating it if needed) the SQLite database at path, which may be
+// ":memory:", and applies any pending migrations
+func openSQLiteDB(path string) (*SQLiteDB, error) {
+	db, err := openSQLiteConn(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := migrateUp(db, "sqlite"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteDB{MyDB{database: db}}, nil
+}
+
+// opens the SQLite database at path as is
+func openSQLiteConn(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows one writer at a time, and every connection to
+	// ":memory:" would get its own empty database
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
@@ -0,0 +1,21 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// returns true if err is an SQLite unique constraint violation. The driver
+// only has its error types when built with cgo, see sqlite_nocgo.go.
+func isSQLiteDuplicateKey(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
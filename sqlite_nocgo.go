@@ -0,0 +1,10 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+// without cgo the SQLite driver refuses to open a database, so there are no
+// SQLite errors to recognise
+func isSQLiteDuplicateKey(err error) bool {
+	return false
+}
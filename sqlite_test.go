@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// returns an empty in-memory database
+func newTestSQLiteDB(t *testing.T) *SQLiteDB {
+	db, err := openSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.database.Close() })
+	return db
+}
+
+func TestSQLiteUsers(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+
+	digest, _ := bcrypt.GenerateFromPassword([]byte("battery horse staple"), bcrypt.MinCost)
+	assert.NoError(t, db.InsertUser(ctx, "user", digest))
+
+	exists, err := db.DoesUserExist(ctx, "user")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = db.DoesUserExist(ctx, "someone-else")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	stored, err := db.GetPasswordDigest(ctx, "user")
+	assert.NoError(t, err)
+	assert.Equal(t, digest, stored)
+	stored, err = db.GetPasswordDigest(ctx, "someone-else")
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+}
+
+func TestSQLiteMessages(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+
+	assert.NoError(t, db.AddMessage(ctx, messageTableName, "a", "user", `"first"`, false, nil))
+	assert.NoError(t, db.AddMessage(ctx, messageTableName, "b", "user", `{"score":7}`, false, nil))
+	assert.NoError(t, db.AddMessage(ctx, messageTableName, "a", "other", `"not yours"`, false, nil))
+	assert.NoError(t, db.AddMessage(ctx, nudgeTableName, "a", "user", `"a nudge"`, false, nil))
+
+	count, err := db.CountMessages(ctx, messageTableName)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+
+	messages, err := db.GetMessages(ctx, messageTableName, "user")
+	assert.NoError(t, err)
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "a", messages[0].Identifier_from)
+		assert.Equal(t, "first", messages[0].Data)
+		assert.Equal(t, "message", messages[0].Channel)
+		assert.WithinDuration(t, time.Now(), messages[0].CreatedAt, time.Minute)
+		assert.Equal(t, map[string]interface{}{"score": 7.0}, messages[1].Data)
+	}
+
+	// someone else's message can't be acked
+	otherMessages, _ := db.GetMessages(ctx, messageTableName, "other")
+	deleted, err := db.AckMessages(ctx, messageTableName, "user",
+		[]int64{messages[0].ID, otherMessages[0].ID})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	messages, _ = db.GetMessages(ctx, messageTableName, "user")
+	assert.Len(t, messages, 1)
+	otherMessages, _ = db.GetMessages(ctx, messageTableName, "other")
+	assert.Len(t, otherMessages, 1)
+	nudges, _ := db.GetMessages(ctx, nudgeTableName, "user")
+	assert.Len(t, nudges, 1)
+}
+
+func TestSQLiteOverwriteMessage(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+
+	assert.NoError(t, db.AddMessage(ctx, messageTableName, "a", "user", `"old"`, true, nil))
+	old, _ := db.GetMessages(ctx, messageTableName, "user")
+	assert.NoError(t, db.AddMessage(ctx, messageTableName, "a", "user", `"new"`, true, nil))
+
+	messages, _ := db.GetMessages(ctx, messageTableName, "user")
+	if assert.Len(t, messages, 1) && assert.Len(t, old, 1) {
+		assert.Equal(t, "new", messages[0].Data)
+		// acking what was fetched before doesn't lose the new one
+		assert.NotEqual(t, old[0].ID, messages[0].ID)
+	}
+
+	// nudges aren't overwritten
+	assert.NoError(t, db.AddMessage(ctx, nudgeTableName, "a", "user", `"first"`, false, nil))
+	assert.NoError(t, db.AddMessage(ctx, nudgeTableName, "a", "user", `"second"`, false, nil))
+	nudges, _ := db.GetMessages(ctx, nudgeTableName, "user")
+	assert.Len(t, nudges, 2)
+}
+
+func TestSQLiteOverwriteMessageConcurrently(t *testing.T) {
+	// a file, so there is a database for more than one connection
+	db, err := openSQLiteDB(filepath.Join(t.TempDir(), "nudgeme.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.database.Close()
+	db.database.SetMaxOpenConns(8)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- db.AddMessage(ctx, messageTableName, "a", "user", strconv.Itoa(i), true, nil)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	count, err := db.CountMessages(ctx, messageTableName)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestSQLiteExpiredMessages(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	assert.NoError(t, db.AddMessage(ctx, nudgeTableName, "a", "user", `"expired"`, false, &past))
+	assert.NoError(t, db.AddMessage(ctx, nudgeTableName, "b", "user", `"pending"`, false, &future))
+	assert.NoError(t, db.AddMessage(ctx, nudgeTableName, "c", "user", `"kept"`, false, nil))
+
+	// left out even before it is swept
+	messages, err := db.GetMessages(ctx, nudgeTableName, "user")
+	if assert.NoError(t, err) && assert.Len(t, messages, 2) {
+		assert.Equal(t, "pending", messages[0].Data)
+		if assert.NotNil(t, messages[0].ExpiresAt) {
+			assert.WithinDuration(t, future, *messages[0].ExpiresAt, time.Second)
+		}
+		assert.Nil(t, messages[1].ExpiresAt)
+	}
+
+	deleted, err := db.DeleteExpiredMessages(ctx, nudgeTableName, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	count, _ := db.CountMessages(ctx, nudgeTableName)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestSQLiteMalformedMessage(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+
+	assert.NoError(t, db.AddMessage(ctx, nudgeTableName, "a", "user", `{not json`, false, nil))
+
+	messages, err := db.GetMessages(ctx, nudgeTableName, "user")
+	assert.NoError(t, err)
+	if assert.Len(t, messages, 1) {
+		assert.True(t, messages[0].Malformed)
+		assert.Equal(t, "{not json", messages[0].Data)
+	}
+}
+
+func TestSQLiteSessions(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+	session := Session{ID: "abc", Identifier: "user", ExpiresAt: time.Now().Add(time.Hour).UTC()}
+
+	assert.NoError(t, db.InsertSession(ctx, session))
+	stored, err := db.GetSession(ctx, "abc")
+	assert.NoError(t, err)
+	if assert.NotNil(t, stored) {
+		assert.Equal(t, "user", stored.Identifier)
+		assert.True(t, session.ExpiresAt.Equal(stored.ExpiresAt))
+	}
+
+	assert.NoError(t, db.DeleteSession(ctx, "abc"))
+	stored, err = db.GetSession(ctx, "abc")
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+}
+
+func TestSQLiteDeleteUser(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+
+	assert.NoError(t, db.InsertUser(ctx, "user", []byte("digest")))
+	assert.NoError(t, db.InsertUser(ctx, "friend", []byte("digest")))
+	assert.NoError(t, db.AddMessage(ctx, messageTableName, "friend", "user", `"to user"`, false, nil))
+	assert.NoError(t, db.AddMessage(ctx, messageTableName, "user", "friend", `"from user"`, false, nil))
+	assert.NoError(t, db.AddMessage(ctx, nudgeTableName, "user", "friend", `"nudge"`, false, nil))
+	assert.NoError(t, db.AddMessage(ctx, messageTableName, "friend", "other", `"unrelated"`, false, nil))
+	assert.NoError(t, db.InsertSession(ctx, Session{ID: "abc", Identifier: "user",
+		ExpiresAt: time.Now().Add(time.Hour)}))
+
+	receipt, err := db.DeleteUser(ctx, "user")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), receipt.Messages)
+		assert.Equal(t, int64(1), receipt.Nudges)
+		assert.Equal(t, int64(1), receipt.Sessions)
+	}
+
+	exists, _ := db.DoesUserExist(ctx, "user")
+	assert.False(t, exists)
+	count, _ := db.CountMessages(ctx, messageTableName)
+	assert.Equal(t, int64(1), count)
+	session, _ := db.GetSession(ctx, "abc")
+	assert.Nil(t, session)
+
+	_, err = db.DeleteUser(ctx, "user")
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestSQLitePublicKeys(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+
+	current, err := db.GetPublicKey(ctx, "user")
+	assert.NoError(t, err)
+	assert.Nil(t, current)
+
+	first := PublicKey{Identifier: "user", PEM: "first", Fingerprint: "1",
+		CreatedAt: time.Now().Add(-time.Hour).UTC().Truncate(time.Second)}
+	second := PublicKey{Identifier: "user", PEM: "second", Fingerprint: "2",
+		CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	assert.NoError(t, db.AddPublicKey(ctx, first))
+	assert.NoError(t, db.AddPublicKey(ctx, second))
+	assert.NoError(t, db.AddPublicKey(ctx, PublicKey{Identifier: "other", PEM: "other",
+		Fingerprint: "3", CreatedAt: time.Now()}))
+
+	current, err = db.GetPublicKey(ctx, "user")
+	if assert.NoError(t, err) && assert.NotNil(t, current) {
+		assert.Equal(t, "second", current.PEM)
+		assert.True(t, second.CreatedAt.Equal(current.CreatedAt))
+	}
+
+	keys, err := db.ListPublicKeys(ctx, "user")
+	if assert.NoError(t, err) && assert.Len(t, keys, 2) {
+		assert.Equal(t, "2", keys[0].Fingerprint)
+		assert.Nil(t, keys[0].ReplacedAt)
+		assert.Equal(t, "1", keys[1].Fingerprint)
+		if assert.NotNil(t, keys[1].ReplacedAt) {
+			assert.True(t, second.CreatedAt.Equal(*keys[1].ReplacedAt))
+		}
+	}
+
+	assert.NoError(t, db.InsertUser(ctx, "user", []byte("digest")))
+	receipt, err := db.DeleteUser(ctx, "user")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), receipt.Keys)
+	}
+	keys, _ = db.ListPublicKeys(ctx, "user")
+	assert.Empty(t, keys)
+}
+
+func TestSQLiteMessageNonces(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Minute)
+
+	fresh, err := db.UseMessageNonce(ctx, "abc", expiresAt)
+	assert.NoError(t, err)
+	assert.True(t, fresh)
+	fresh, err = db.UseMessageNonce(ctx, "abc", expiresAt)
+	assert.NoError(t, err)
+	assert.False(t, fresh)
+
+	// forgotten once expired
+	fresh, _ = db.UseMessageNonce(ctx, "old", time.Now().Add(-time.Minute))
+	assert.True(t, fresh)
+	fresh, err = db.UseMessageNonce(ctx, "old", expiresAt)
+	assert.NoError(t, err)
+	assert.True(t, fresh)
+}
+
+func TestSQLiteContacts(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+
+	// stored the same whichever way round it is looked up
+	assert.NoError(t, db.SaveContact(ctx, newContact("zed", "amy")))
+	contact, err := db.GetContact(ctx, "amy", "zed")
+	if assert.NoError(t, err) && assert.NotNil(t, contact) {
+		assert.Equal(t, "amy", contact.IdentifierA)
+		assert.Equal(t, "zed", contact.RequestedBy)
+		assert.True(t, contact.awaits("amy"))
+	}
+
+	contact.Status = contactAccepted
+	assert.NoError(t, db.SaveContact(ctx, *contact))
+	assert.NoError(t, db.SaveContact(ctx, newContact("amy", "bob")))
+	contacts, err := db.ListContacts(ctx, "amy")
+	assert.NoError(t, err)
+	assert.Len(t, contacts, 2)
+	contact, _ = db.GetContact(ctx, "zed", "amy")
+	assert.Equal(t, contactAccepted, contact.Status)
+
+	deleted, err := db.DeleteContact(ctx, "bob", "amy")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	deleted, _ = db.DeleteContact(ctx, "bob", "amy")
+	assert.False(t, deleted)
+
+	assert.NoError(t, db.InsertUser(ctx, "zed", []byte("digest")))
+	receipt, err := db.DeleteUser(ctx, "zed")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), receipt.Contacts)
+	}
+	contacts, _ = db.ListContacts(ctx, "amy")
+	assert.Empty(t, contacts)
+}
+
+func TestSQLiteBlocksAndReports(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+
+	assert.NoError(t, db.BlockUser(ctx, "user", "troll"))
+	assert.NoError(t, db.BlockUser(ctx, "user", "troll"))
+	blocked, err := db.IsBlocked(ctx, "user", "troll")
+	assert.NoError(t, err)
+	assert.True(t, blocked)
+	// only one way
+	blocked, _ = db.IsBlocked(ctx, "troll", "user")
+	assert.False(t, blocked)
+
+	unblocked, err := db.UnblockUser(ctx, "user", "troll")
+	assert.NoError(t, err)
+	assert.True(t, unblocked)
+	unblocked, _ = db.UnblockUser(ctx, "user", "troll")
+	assert.False(t, unblocked)
+
+	report := Report{Reporter: "user", Reported: "troll", Channel: "nudge", MessageID: 12,
+		Data: "{\"text\":\"boo\"}", Reason: "rude", CreatedAt: time.Now().UTC().Truncate(time.Second)}
+	first, err := db.AddReport(ctx, report)
+	assert.NoError(t, err)
+	second, _ := db.AddReport(ctx, report)
+	assert.NotEqual(t, first, second)
+
+	resolved, err := db.ResolveReport(ctx, first)
+	assert.NoError(t, err)
+	assert.True(t, resolved)
+	resolved, _ = db.ResolveReport(ctx, first)
+	assert.False(t, resolved)
+
+	reports, err := db.ListOpenReports(ctx)
+	if assert.NoError(t, err) && assert.Len(t, reports, 1) {
+		assert.Equal(t, second, reports[0].ID)
+		assert.Equal(t, "rude", reports[0].Reason)
+		assert.Equal(t, report.Data, reports[0].Data)
+		assert.True(t, report.CreatedAt.Equal(reports[0].CreatedAt))
+	}
+}
+
+func TestSQLiteWellbeingRecords(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx := context.Background()
+
+	record := WellbeingRecord{PostCode: "TW6", WellbeingScore: 8, SupportCode: "GP",
+		DateSent: "2021-03-14"}
+	assert.NoError(t, insertWellbeingRecord(ctx, record, db.database))
+	record.WellbeingScore = 6
+	assert.NoError(t, insertWellbeingRecord(ctx, record, db.database))
+
+	mapT, err := getMapTemplate(ctx, db.database, false)
+	if assert.NoError(t, err) {
+		assert.Contains(t, mapT.MAPDATA, `"avgscore":7`)
+		assert.Contains(t, mapT.MAPDATA, `"quantity":2`)
+		assert.Contains(t, mapT.SUPCODE, `"supportcode":"GP"`)
+	}
+
+	mockT, err := getMapTemplate(ctx, db.database, true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "[]", mockT.MAPDATA)
+	}
+}
+
+func TestSQLiteCancelledContext(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := db.DoesUserExist(ctx, "user")
+	assert.ErrorIs(t, err, context.Canceled)
+}
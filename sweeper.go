@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// starts a goroutine deleting expired messages from the mailbox tables, and
+// expired sessions, every interval until ctx is cancelled. wg is done once it
+// has stopped.
+func startMessageSweeper(ctx context.Context, wg *sync.WaitGroup,
+	db DataSource, interval time.Duration) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			sweepExpiredMessages(ctx, db)
+			sweepExpiredSessions(ctx, db)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// deletes the expired messages from each mailbox table. Failures are only
+// logged, the next sweep tries again.
+func sweepExpiredMessages(ctx context.Context, db DataSource) {
+	start := time.Now()
+	for _, tableName := range []string{messageTableName, nudgeTableName} {
+		deleted, err := db.DeleteExpiredMessages(ctx, tableName, time.Now())
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Print(err)
+				messageSweepErrors.Inc()
+			}
+			continue
+		}
+		messagesExpired.WithLabelValues(channelNames[tableName]).Add(float64(deleted))
+		if deleted > 0 {
+			log.Printf("deleted %d expired message(s) from %s", deleted, tableName)
+		}
+	}
+	messageSweepDuration.Observe(time.Since(start).Seconds())
+}
+
+// deletes the sessions that have expired, which Verify refuses anyway
+func sweepExpiredSessions(ctx context.Context, db DataSource) {
+	deleted, err := db.DeleteExpiredSessions(ctx, time.Now())
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Print(err)
+			messageSweepErrors.Inc()
+		}
+		return
+	}
+	sessionsExpired.Add(float64(deleted))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageSweeper(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+
+	past := time.Now().Add(-time.Minute)
+	if err := db.AddMessage(ctx, messageTableName, "a", "user", `"old"`, true, &past); err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(messagesExpired.WithLabelValues("message"))
+
+	startMessageSweeper(ctx, &wg, db, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(messagesExpired.WithLabelValues("message")) == before+1
+	}, time.Second, 5*time.Millisecond)
+	count, _ := db.CountMessages(ctx, messageTableName)
+	assert.Equal(t, int64(0), count)
+
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("message sweeper didn't stop")
+	}
+}
+
+func TestSessionSweeper(t *testing.T) {
+	db := newTestSQLiteDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+
+	for id, expiresAt := range map[string]time.Time{
+		"old": time.Now().Add(-time.Minute), "current": time.Now().Add(time.Hour)} {
+		err := db.InsertSession(ctx, Session{ID: id, Identifier: "user", ExpiresAt: expiresAt})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := testutil.ToFloat64(sessionsExpired)
+
+	startMessageSweeper(ctx, &wg, db, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(sessionsExpired) == before+1
+	}, time.Second, 5*time.Millisecond)
+	session, err := db.GetSession(ctx, "old")
+	assert.NoError(t, err)
+	assert.Nil(t, session)
+	session, err = db.GetSession(ctx, "current")
+	assert.NoError(t, err)
+	assert.NotNil(t, session)
+
+	cancel()
+	wg.Wait()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	_ "embed"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// limits on what can be signed up with. Identifiers end up in nudgeme://
+// links, so they are kept to characters that are safe in a URL.
+const (
+	minIdentifierLength = 3
+	maxIdentifierLength = 32
+	minPasswordLength   = 8
+	maxPasswordLength   = 256 // hashing huge passwords is a cheap way to load us
+
+	// checked before counting characters, which are up to 4 bytes each
+	maxPasswordBytes = 4 * maxPasswordLength
+)
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+// longest reason a user can give when reporting a message, in characters
+const maxReportReasonLength = 1000
+
+//go:embed common_passwords.txt
+var commonPasswordsFile string
+
+// lower case, see common_passwords.txt
+var commonPasswords = parseCommonPasswords(commonPasswordsFile)
+
+func parseCommonPasswords(file string) map[string]bool {
+	passwords := make(map[string]bool)
+	for _, line := range strings.Split(file, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			passwords[strings.ToLower(line)] = true
+		}
+	}
+	return passwords
+}
+
+// returns what is wrong with identifier, or "" if it can be signed up with
+func validateIdentifier(identifier string) string {
+	if len(identifier) < minIdentifierLength || len(identifier) > maxIdentifierLength {
+		return "Identifier must be between 3 and 32 characters."
+	}
+	if !identifierPattern.MatchString(identifier) {
+		return "Identifier can only contain letters, numbers, - and _."
+	}
+	return ""
+}
+
+// returns what is wrong with password for identifier's account, or "" if
+// it is acceptable
+func validatePassword(identifier string, password string) string {
+	if len(password) > maxPasswordBytes {
+		return "Password must be at most 256 characters."
+	}
+	length := utf8.RuneCountInString(password)
+	if length < minPasswordLength {
+		return "Password must be at least 8 characters."
+	}
+	if length > maxPasswordLength {
+		return "Password must be at most 256 characters."
+	}
+	if commonPasswords[strings.ToLower(password)] ||
+		strings.EqualFold(password, identifier) {
+		return "Password is too easy to guess."
+	}
+	return ""
+}
+
+// returns what is wrong with each field of report
+func validateReport(report *ReportJSON) map[string]string {
+	fields := make(map[string]string)
+	if report.Reported == "" {
+		fields["reported"] = "Say who sent the message."
+	}
+	if report.Channel != channelNames[messageTableName] && report.Channel != channelNames[nudgeTableName] {
+		fields["channel"] = "Channel must be \"message\" or \"nudge\"."
+	}
+	if report.MessageID <= 0 {
+		fields["message_id"] = "Say which message is being reported."
+	}
+	if utf8.RuneCountInString(report.Reason) > maxReportReasonLength {
+		fields["reason"] = "Reason must be at most 1000 characters."
+	}
+	return fields
+}
+
+// returns a validation APIError with a reason for each field, or nil if there
+// aren't any
+func validationError(fields map[string]string) *APIError {
+	for field, reason := range fields {
+		if reason == "" {
+			delete(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	// in a stable order, for the combined reason
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	reasons := make([]string, len(names))
+	for i, field := range names {
+		reasons[i] = fields[field]
+	}
+	return &APIError{Code: codeValidation, Reason: strings.Join(reasons, " "), Fields: fields}
+}
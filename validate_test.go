@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateIdentifier(t *testing.T) {
+	for _, identifier := range []string{"abc1337", "user", "not-existing", "a_b"} {
+		assert.Empty(t, validateIdentifier(identifier), identifier)
+	}
+	for _, identifier := range []string{"", "ab", strings.Repeat("a", 33),
+		"has space", "quote\"", "<script>", "dots.are.out", "ünïcode"} {
+		assert.NotEmpty(t, validateIdentifier(identifier), identifier)
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	assert.Empty(t, validatePassword("user", "battery horse staple"))
+	assert.Empty(t, validatePassword("user", "ünïcödé!"), "8 characters, more bytes")
+
+	assert.NotEmpty(t, validatePassword("user", ""))
+	assert.NotEmpty(t, validatePassword("user", "short"))
+	assert.NotEmpty(t, validatePassword("user", strings.Repeat("a", 257)))
+	assert.Empty(t, validatePassword("user", strings.Repeat("ü", 200)), "200 characters, 400 bytes")
+	assert.NotEmpty(t, validatePassword("user", strings.Repeat("ü", 257)))
+	assert.NotEmpty(t, validatePassword("user", "Password123"), "common, ignoring case")
+	assert.NotEmpty(t, validatePassword("abc13370", "ABC13370"), "same as the identifier")
+}
+
+func TestValidationErrorFields(t *testing.T) {
+	assert.Nil(t, validationError(map[string]string{"identifier": "", "password": ""}))
+
+	apiErr := validationError(map[string]string{"password": "B.", "identifier": "A.", "other": ""})
+	if assert.NotNil(t, apiErr) {
+		assert.Equal(t, codeValidation, apiErr.Code)
+		assert.Equal(t, "A. B.", apiErr.Reason)
+		assert.Equal(t, map[string]string{"identifier": "A.", "password": "B."}, apiErr.Fields)
+	}
+}